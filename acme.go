@@ -0,0 +1,47 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns an autocert.Manager which obtains and renews
+// certificates for domains from the ACME directory at dirURL, and caches them
+// in cacheDir. TLS-ALPN-01 challenges are always answered, and HTTP-01
+// challenges are answered if the manager's HTTPHandler is served on port 80.
+func newACMEManager(domains []string, email, dirURL, cacheDir string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client: &acme.Client{
+			DirectoryURL: dirURL,
+		},
+	}
+}
+
+// acmeTLSConfig returns a tls.Config which gets certificates from m and
+// supports the TLS-ALPN-01 challenge.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// defaultACMECache returns the default directory to store ACME accounts and
+// certificates in.
+func defaultACMECache() string {
+	if d, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(d, "easy-novnc", "acme")
+	}
+	return "easy-novnc-acme"
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEManager(t *testing.T) {
+	m := newACMEManager([]string{"example.com", "vnc.example.com"}, "admin@example.com", "https://localhost:14000/dir", t.Name())
+
+	if m.Client.DirectoryURL != "https://localhost:14000/dir" {
+		t.Errorf("wrong directory url %#v", m.Client.DirectoryURL)
+	}
+	if m.Email != "admin@example.com" {
+		t.Errorf("wrong email %#v", m.Email)
+	}
+
+	for host, allowed := range map[string]bool{
+		"example.com":       true,
+		"vnc.example.com":   true,
+		"other.example.com": false,
+		"localhost":         false,
+	} {
+		if err := m.HostPolicy(context.Background(), host); allowed && err != nil {
+			t.Errorf("expected %#v to be allowed: %v", host, err)
+		} else if !allowed && err == nil {
+			t.Errorf("expected %#v not to be allowed", host)
+		}
+	}
+
+	var alpn bool
+	for _, p := range acmeTLSConfig(m).NextProtos {
+		if p == acme.ALPNProto {
+			alpn = true
+		}
+	}
+	if !alpn {
+		t.Errorf("expected tls config to support the tls-alpn-01 challenge")
+	}
+}
@@ -0,0 +1,57 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// adminHandler creates the handler for the admin API.
+func adminHandler(reload func() error, sessions *sessionRegistry) http.Handler {
+	r := mux.NewRouter()
+	r.Use(noCache)
+	r.Use(serverHeader)
+
+	r.Methods("POST").Path("/api/reload").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := reload(); err != nil {
+			logr(r, levelError, "error reloading configuration from admin api (%s), keeping the old one: %v.\n", requestWho(r), err)
+			http.Error(w, fmt.Sprintf("error reloading configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "reloaded")
+	})
+
+	r.Methods("GET").Path("/api/sessions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss := sessions.List()
+		info := make([]sessionInfo, len(ss))
+		for i, s := range ss {
+			info[i] = s.Info()
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(info)
+	})
+
+	r.Methods("DELETE").Path("/api/sessions/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := sessions.Get(mux.Vars(r)["id"])
+		if s == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		stdLogger.Log(levelInfo, []logField{{"session", s.ID}}, "Terminating session %s from admin api (%s)\n", s, requestWho(r))
+		s.Close()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "terminated")
+	})
+
+	// the noVNC files are also served here for use as the player
+	r.Handle("/replay/{id:[a-zA-Z0-9_-]+}", replayHandler())
+	r.NotFoundHandler = fs("noVNC-master", noVNC)
+
+	return r
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminReload(t *testing.T) {
+	var fail bool
+	var n int
+	h := adminHandler(func() error {
+		n++
+		if fail {
+			return errors.New("test error")
+		}
+		return nil
+	}, newSessionRegistry())
+
+	for _, c := range []struct {
+		Method string
+		Fail   bool
+		Status int
+		Body   string
+	}{
+		{"GET", false, http.StatusMethodNotAllowed, ""},
+		{"POST", false, http.StatusOK, "reloaded"},
+		{"POST", true, http.StatusInternalServerError, "test error"},
+	} {
+		fail = c.Fail
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.Method, "http://localhost/api/reload", nil))
+
+		if s := w.Result().StatusCode; s != c.Status {
+			t.Errorf("%s: expected status %d, got %d", c.Method, c.Status, s)
+		}
+		if buf, _ := ioutil.ReadAll(w.Result().Body); !strings.Contains(string(buf), c.Body) {
+			t.Errorf("%s: expected body to contain %#v, got %#v", c.Method, c.Body, string(buf))
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected reload to be called twice, got %d", n)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	reg := newSessionRegistry()
+	h := adminHandler(func() error { return nil }, reg)
+
+	var closed bool
+	start := time.Date(2020, 6, 1, 15, 4, 5, 0, time.UTC)
+	s := &session{ID: "0123456789abcdef", Client: "127.0.0.1:1234", User: "user", Target: "localhost:5900", Start: start, close: func() {
+		closed = true
+	}}
+	s.CountToServer(5)
+	s.CountToClient(10)
+	if err := reg.Add(s); err != nil {
+		panic(err)
+	}
+	if err := reg.Add(&session{ID: "fedcba9876543210", Client: "127.0.0.1:5678", Target: "localhost:5900", Start: start.Add(time.Second)}); err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/api/sessions", nil))
+	if s := w.Result().StatusCode; s != http.StatusOK {
+		t.Errorf("list: expected status 200, got %d", s)
+	}
+	var info []sessionInfo
+	if err := json.NewDecoder(w.Result().Body).Decode(&info); err != nil {
+		t.Fatalf("list: unexpected error: %v", err)
+	}
+	if len(info) != 2 {
+		t.Fatalf("list: expected 2 sessions, got %d", len(info))
+	}
+	if exp := s.Info(); info[0] != exp {
+		t.Errorf("list: expected %+v, got %+v", exp, info[0])
+	}
+	if info[0].BytesToServer != 5 || info[0].BytesToClient != 10 {
+		t.Errorf("list: incorrect byte counters: %+v", info[0])
+	}
+	if info[1].ID != "fedcba9876543210" {
+		t.Errorf("list: expected sessions to be sorted by start time")
+	}
+
+	for _, c := range []struct {
+		ID     string
+		Status int
+		Closed bool
+	}{
+		{"unknown", http.StatusNotFound, false},
+		{"0123456789abcdef", http.StatusOK, true},
+	} {
+		closed = false
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("DELETE", "http://localhost/api/sessions/"+c.ID, nil))
+		if s := w.Result().StatusCode; s != c.Status {
+			t.Errorf("delete %s: expected status %d, got %d", c.ID, c.Status, s)
+		}
+		if closed != c.Closed {
+			t.Errorf("delete %s: expected closed to be %t", c.ID, c.Closed)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd checks credentials against the entries of a htpasswd file. Only
+// bcrypt and SHA1 ({SHA}) hashes are supported.
+type htpasswd struct {
+	users map[string]string
+
+	// bcrypt is intentionally slow, so successful checks are cached (keyed by
+	// a hash of the credentials) to avoid slowing down every static file.
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// loadHtpasswd reads and parses a htpasswd file.
+func loadHtpasswd(fn string) (*htpasswd, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := parseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return h, nil
+}
+
+// parseHtpasswd parses a htpasswd file.
+func parseHtpasswd(r io.Reader) (*htpasswd, error) {
+	h := &htpasswd{
+		users:    map[string]string{},
+		verified: map[[sha256.Size]byte]bool{},
+	}
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		spl := strings.SplitN(line, ":", 2)
+		if len(spl) != 2 || spl[0] == "" {
+			return nil, fmt.Errorf("line %d: must be in user:hash format", n)
+		}
+
+		switch {
+		case strings.HasPrefix(spl[1], "$2a$"), strings.HasPrefix(spl[1], "$2b$"), strings.HasPrefix(spl[1], "$2y$"):
+			if _, err := bcrypt.Cost([]byte(spl[1])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid bcrypt hash for user %#v: %v", n, spl[0], err)
+			}
+		case strings.HasPrefix(spl[1], "{SHA}"):
+			if buf, err := base64.StdEncoding.DecodeString(spl[1][5:]); err != nil || len(buf) != sha1.Size {
+				return nil, fmt.Errorf("line %d: invalid sha1 hash for user %#v", n, spl[0])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unsupported hash type for user %#v (only bcrypt and sha1 are supported)", n, spl[0])
+		}
+
+		if _, ok := h.users[spl[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %#v", n, spl[0])
+		}
+		h.users[spl[0]] = spl[1]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Check checks whether the username and password are valid.
+func (h *htpasswd) Check(user, pass string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	h.mu.Lock()
+	ok = h.verified[key]
+	h.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		ok = subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+
+	if ok {
+		h.mu.Lock()
+		h.verified[key] = true
+		h.mu.Unlock()
+	}
+	return ok
+}
+
+// basicAuth requires HTTP basic authentication for a http.Handler, and sets the
+// request user. Requests which were already authenticated (e.g. by proxyAuth)
+// are passed through as-is. Note that this also applies to websocket upgrade
+// requests, which browsers send the cached credentials for.
+func basicAuth(realm string, h *htpasswd) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestUser(r) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user, pass, ok := r.BasicAuth()
+			if !ok || !h.Check(user, pass) {
+				if ok {
+					logf(levelWarn, "authentication failed for user %#v from %s\n", user, r.RemoteAddr)
+				}
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, withUser(r, user))
+		})
+	}
+}
+
+// proxyAuth sets the request user from a header set by an authenticating
+// reverse proxy. The header is only trusted if the request comes directly from
+// one of the trusted CIDRs or over a unix socket (which can only be connected
+// to by users allowed by its permissions), and requests from anywhere else
+// which contain the header are rejected. If optional is false, requests
+// without a user (i.e. which didn't go through the proxy) are also rejected.
+func proxyAuth(header string, trusted []*net.IPNet, optional bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := r.Header.Get(header)
+			if user != "" {
+				if !requestFromUnixSocket(r) && !remoteAddrInCIDRList(r.RemoteAddr, trusted) {
+					logf(levelWarn, "rejected request from untrusted source %s with %s header %#v\n", r.RemoteAddr, header, user)
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, withUser(r, user))
+				return
+			}
+			if !optional {
+				logf(levelWarn, "rejected request from %s without %s header\n", r.RemoteAddr, header)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestFromUnixSocket checks if a request was received on a unix socket
+// listener.
+func requestFromUnixSocket(r *http.Request) bool {
+	a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && a.Network() == "unix"
+}
+
+// remoteAddrInCIDRList checks if the IP of a remote address is in a list of
+// CIDRs.
+func remoteAddrInCIDRList(remoteAddr string, cidrs []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type ctxKey int
+
+const (
+	ctxKeyUser ctxKey = iota
+	ctxKeyTarget
+	ctxKeySession
+	ctxKeyReplay
+)
+
+// withUser returns a shallow copy of the request with the authenticated user
+// set.
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyUser, user))
+}
+
+// requestUser returns the authenticated user for a request, if any.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(ctxKeyUser).(string)
+	return user
+}
+
+// requestWho returns a description of the client for log messages.
+func requestWho(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return fmt.Sprintf("%s (%s)", r.RemoteAddr, user)
+	}
+	return r.RemoteAddr
+}
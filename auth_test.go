@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+
+	h, err := parseHtpasswd(strings.NewReader(strings.Join([]string{
+		"# comment",
+		"bcryptuser:" + string(bc),
+		"",
+		"shauser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", // password
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		User, Pass string
+		OK         bool
+	}{
+		{"bcryptuser", "bcryptpass", true},
+		{"bcryptuser", "bcryptpass", true}, // cached
+		{"bcryptuser", "password", false},
+		{"shauser", "password", true},
+		{"shauser", "bcryptpass", false},
+		{"shauser", "", false},
+		{"nobody", "password", false},
+		{"", "", false},
+	} {
+		if ok := h.Check(c.User, c.Pass); ok != c.OK {
+			t.Errorf("expected check for %#v:%#v to be %t, got %t", c.User, c.Pass, c.OK, ok)
+		}
+	}
+
+	for _, c := range []string{
+		"user",
+		":{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"user:{SHA}invalid",
+		"user:$apr1$abc$def",
+		"user:plaintext",
+		"user:$2y$invalid",
+		"user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\nuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		if _, err := parseHtpasswd(strings.NewReader(c)); err == nil {
+			t.Errorf("expected error parsing %#v", c)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h, err := parseHtpasswd(strings.NewReader("user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	if err != nil {
+		panic(err)
+	}
+
+	handler := basicAuth("test", h)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for _, c := range []struct {
+		Name      string
+		User      string
+		Pass      string
+		WebSocket bool
+		Status    int
+	}{
+		{"NoAuth", "", "", false, http.StatusUnauthorized},
+		{"BadPassword", "user", "wrong", false, http.StatusUnauthorized},
+		{"BadUser", "wrong", "password", false, http.StatusUnauthorized},
+		{"Valid", "user", "password", false, http.StatusTeapot},
+		{"WebSocketNoAuth", "", "", true, http.StatusUnauthorized},
+		{"WebSocketValid", "user", "password", true, http.StatusTeapot},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/vnc", nil)
+			if c.User != "" {
+				r.SetBasicAuth(c.User, c.Pass)
+			}
+			if c.WebSocket {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if s := w.Result().StatusCode; s != c.Status {
+				t.Errorf("expected status %d, got %d", c.Status, s)
+			}
+			if a := w.Result().Header.Get("WWW-Authenticate"); (c.Status == http.StatusUnauthorized) != strings.HasPrefix(a, `Basic realm="test"`) {
+				t.Errorf("unexpected WWW-Authenticate header %#v", a)
+			}
+		})
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	h, err := parseHtpasswd(strings.NewReader("user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, c := range []struct {
+		Name       string
+		RemoteAddr string
+		Unix       bool
+		Header     string
+		BasicAuth  bool
+		Optional   bool
+		Status     int
+		User       string
+	}{
+		{"Trusted", "10.0.0.5:1234", false, "alice", false, false, http.StatusTeapot, "alice"},
+		{"TrustedIPv6", "[a:b:c:d:a:b:c:1]:1234", false, "alice", false, false, http.StatusTeapot, "alice"},
+		{"TrustedNoHeader", "10.0.0.5:1234", false, "", false, false, http.StatusUnauthorized, ""},
+		{"UntrustedHeader", "192.168.0.5:1234", false, "alice", false, false, http.StatusForbidden, ""},
+		{"UntrustedHeaderOptional", "192.168.0.5:1234", false, "alice", true, true, http.StatusForbidden, ""},
+		{"UntrustedNoHeader", "192.168.0.5:1234", false, "", false, false, http.StatusUnauthorized, ""},
+		{"TrustedOptional", "10.0.0.5:1234", false, "alice", false, true, http.StatusTeapot, "alice"},
+		{"FallbackBasicAuth", "192.168.0.5:1234", false, "", true, true, http.StatusTeapot, "user"},
+		{"FallbackNoBasicAuth", "192.168.0.5:1234", false, "", false, true, http.StatusUnauthorized, ""},
+		{"UnixSocket", "@", true, "alice", false, false, http.StatusTeapot, "alice"},
+		{"UnixSocketNoHeader", "@", true, "", false, false, http.StatusUnauthorized, ""},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var user string
+			handler := proxyAuth("X-Forwarded-User", mustParseCIDRList("10.0.0.0/24,a:b:c:d:a:b:c:d/120"), c.Optional)(basicAuth("test", h)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user = requestUser(r)
+				w.WriteHeader(http.StatusTeapot)
+			})))
+
+			r := httptest.NewRequest("GET", "http://example.com/vnc", nil)
+			r.RemoteAddr = c.RemoteAddr
+			if c.Unix {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/easy-novnc.sock", Net: "unix"}))
+			}
+			if c.Header != "" {
+				r.Header.Set("X-Forwarded-User", c.Header)
+			}
+			if c.BasicAuth {
+				r.SetBasicAuth("user", "password")
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if s := w.Result().StatusCode; s != c.Status {
+				t.Errorf("expected status %d, got %d", c.Status, s)
+			}
+			if user != c.User {
+				t.Errorf("expected user %#v, got %#v", c.User, user)
+			}
+		})
+	}
+}
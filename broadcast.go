@@ -0,0 +1,503 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// broadcasts contains the active broadcast groups.
+var broadcasts = newBroadcastRegistry()
+
+// broadcastPixelFormat is the pixel format used for broadcast connections,
+// which is the one noVNC always requests (32bpp little-endian RGB).
+var broadcastPixelFormat = rfbPixelFormat{32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 0, 8, 16}
+
+// broadcastEncodings are the encodings requested from the server for broadcast
+// connections. Only stateless encodings can be used since every viewer must be
+// able to decode each update without having seen the previous ones (so not
+// CopyRect, which copies from the framebuffer the viewer already has), and the
+// cursor pseudo-encoding isn't used since late joiners wouldn't get the shape.
+var broadcastEncodings = []int32{rfbEncHextile, rfbEncRRE, rfbEncCoRRE, rfbEncRaw}
+
+// broadcastQueue is the number of messages which can be queued for a viewer
+// before it is disconnected for being too slow.
+const broadcastQueue = 256
+
+// errBroadcastSlow is returned when a viewer is disconnected because it can't
+// keep up with the updates.
+var errBroadcastSlow = errors.New("viewer too slow, dropped")
+
+// broadcastRegistry keeps track of the upstream connections shared between
+// viewers of broadcast targets.
+type broadcastRegistry struct {
+	mu     sync.Mutex // also protects the viewers of each group
+	groups map[string]*broadcastGroup
+}
+
+// newBroadcastRegistry creates a new broadcastRegistry.
+func newBroadcastRegistry() *broadcastRegistry {
+	return &broadcastRegistry{
+		groups: map[string]*broadcastGroup{},
+	}
+}
+
+// broadcastGroup is a single upstream connection shared between viewers.
+type broadcastGroup struct {
+	br   *broadcastRegistry
+	key  string
+	name string
+	addr string
+
+	ready chan struct{} // closed once connected (or failed)
+	err   error         // set before ready is closed
+	done  chan struct{} // closed once the upstream connection ends
+
+	conn net.Conn
+	s    *bufio.Reader
+	h    *rfbHandshake
+	wmu  sync.Mutex // for writes to conn
+
+	viewers    []*broadcastViewer // in join order
+	controller *broadcastViewer
+	closed     bool
+}
+
+// broadcastViewer is a websocket connection viewing a broadcast group.
+type broadcastViewer struct {
+	r          *http.Request
+	p          rfbProxy
+	canControl bool
+
+	ch   chan rfbServerMessage
+	gone chan struct{} // closed if the viewer falls behind
+}
+
+// Join adds a viewer to the group for the named target, connecting to addr
+// using dial and p if there isn't an active one already. It blocks until the
+// group is connected.
+func (br *broadcastRegistry) Join(name, addr string, dial dialFunc, p rfbProxy, v *broadcastViewer) (*broadcastGroup, error) {
+	key := name + "\x00" + addr
+
+	br.mu.Lock()
+	g, ok := br.groups[key]
+	if !ok {
+		g = &broadcastGroup{
+			br:    br,
+			key:   key,
+			name:  name,
+			addr:  addr,
+			ready: make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		br.groups[key] = g
+		go br.run(g, v.r, dial, rfbProxy{Policies: p.Policies, Password: p.Password, ForceExclusive: p.ForceExclusive})
+	}
+	g.viewers = append(g.viewers, v)
+	br.updateController(g)
+	br.mu.Unlock()
+
+	<-g.ready
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g, nil
+}
+
+// Leave removes a viewer from a group, closing the upstream connection if it
+// was the last one.
+func (br *broadcastRegistry) Leave(g *broadcastGroup, v *broadcastViewer) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for i, x := range g.viewers {
+		if x == v {
+			g.viewers = append(g.viewers[:i], g.viewers[i+1:]...)
+			break
+		}
+	}
+	if len(g.viewers) == 0 {
+		br.remove(g)
+		if g.conn != nil {
+			g.conn.Close()
+		}
+		return
+	}
+	br.updateController(g)
+}
+
+// Len returns the number of viewers of the named target.
+func (br *broadcastRegistry) Len(name, addr string) int {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if g, ok := br.groups[name+"\x00"+addr]; ok {
+		return len(g.viewers)
+	}
+	return 0
+}
+
+// remove removes the group from the registry so new viewers get a new one. It
+// must be called with the lock held.
+func (br *broadcastRegistry) remove(g *broadcastGroup) {
+	if !g.closed {
+		g.closed = true
+		if br.groups[g.key] == g {
+			delete(br.groups, g.key)
+		}
+	}
+}
+
+// updateController gives control to the first viewer which is allowed to
+// control the target if the current controller left. It must be called with
+// the lock held.
+func (br *broadcastRegistry) updateController(g *broadcastGroup) {
+	for _, v := range g.viewers {
+		if v == g.controller {
+			return
+		}
+	}
+	g.controller = nil
+	for _, v := range g.viewers {
+		if v.canControl {
+			g.controller = v
+			logr(v.r, levelInfo, "broadcast %#v: %s is now in control\n", g.name, requestWho(v.r))
+			return
+		}
+	}
+}
+
+// run connects to the server and broadcasts its messages to the viewers until
+// the connection ends.
+func (br *broadcastRegistry) run(g *broadcastGroup, r *http.Request, dial dialFunc, p rfbProxy) {
+	g.err = g.connect(r, dial, p)
+	if g.err != nil {
+		logf(levelWarn, "broadcast %#v: error connecting to %s: %v\n", g.name, g.addr, g.err)
+		br.mu.Lock()
+		br.remove(g)
+		br.mu.Unlock()
+		close(g.ready)
+		close(g.done)
+		return
+	}
+	logf(levelInfo, "broadcast %#v: connected to %s: %s\n", g.name, g.addr, g.h)
+	close(g.ready)
+
+	err := br.copyServer(g)
+
+	br.mu.Lock()
+	left := g.closed // i.e. the last viewer left
+	br.remove(g)
+	br.mu.Unlock()
+	g.conn.Close()
+	close(g.done)
+
+	if left || err == io.EOF {
+		logf(levelInfo, "broadcast %#v: disconnected from %s\n", g.name, g.addr)
+	} else {
+		logf(levelInfo, "broadcast %#v: disconnected from %s: %v\n", g.name, g.addr, err)
+	}
+}
+
+// connect connects to the server for the request which created the group, and
+// sets the pixel format and encodings.
+func (g *broadcastGroup) connect(r *http.Request, dial dialFunc, p rfbProxy) error {
+	conn, err := dial(r)
+	if err != nil {
+		metricRejected.WithLabelValues(rejectDial).Inc()
+		return err
+	}
+
+	// note: the timeout only applies to the handshake
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	s := bufio.NewReader(conn)
+	h, err := p.ClientHandshake(rfbConn{s, conn}, !p.ForceExclusive)
+	if err != nil {
+		conn.Close()
+		if perr, ok := err.(*rfbPolicyError); ok {
+			metricRejected.WithLabelValues(perr.Reason).Inc()
+		}
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	h.PixelFormat = broadcastPixelFormat
+
+	g.conn, g.s, g.h = conn, s, h
+
+	pf := make(rfbClientMessage, 20)
+	pf[0] = rfbSetPixelFormat
+	copy(pf[4:], broadcastPixelFormat[:])
+	if err := g.send(pf); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := g.send(newRFBSetEncodings(broadcastEncodings)); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := g.request(false); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// copyServer reads messages from the server and queues them for each viewer.
+func (br *broadcastRegistry) copyServer(g *broadcastGroup) error {
+	fb := rfbFramebuffer{broadcastPixelFormat, int(g.h.Width), int(g.h.Height)}
+	for {
+		m, err := readRFBServerMessage(g.s, &fb)
+		if err != nil {
+			return err
+		}
+		if m.Type() == rfbFramebufferUpdate {
+			// the proxy requests the updates for all viewers
+			if err := g.request(true); err != nil {
+				return err
+			}
+		}
+		br.mu.Lock()
+		for _, v := range g.viewers {
+			select {
+			case v.ch <- m:
+			case <-v.gone:
+			default:
+				close(v.gone)
+			}
+		}
+		br.mu.Unlock()
+	}
+}
+
+// send writes a message to the server.
+func (g *broadcastGroup) send(m rfbClientMessage) error {
+	g.wmu.Lock()
+	defer g.wmu.Unlock()
+	_, err := g.conn.Write(m)
+	return err
+}
+
+// request requests a framebuffer update for the entire screen.
+func (g *broadcastGroup) request(incremental bool) error {
+	m := make(rfbClientMessage, 10)
+	m[0] = rfbFramebufferUpdateReq
+	if incremental {
+		m[1] = 1
+	}
+	binary.BigEndian.PutUint16(m[6:], g.h.Width)
+	binary.BigEndian.PutUint16(m[8:], g.h.Height)
+	return g.send(m)
+}
+
+// IsController returns true if v currently has control of the group.
+func (g *broadcastGroup) IsController(v *broadcastViewer) bool {
+	g.br.mu.Lock()
+	defer g.br.mu.Unlock()
+	return g.controller == v
+}
+
+// ServerInit returns the ServerInit message to send to viewers.
+func (g *broadcastGroup) ServerInit() []byte {
+	return g.h.ServerInit()
+}
+
+// copyViewer handles messages from a viewer until it disconnects. Input is
+// only forwarded from the controller, and everything else other than requests
+// for a full update is dropped since the proxy manages the connection.
+func (g *broadcastGroup) copyViewer(v *broadcastViewer, c *bufio.Reader, count func(n int)) error {
+	for {
+		m, err := readRFBClientMessage(c)
+		if err != nil {
+			return err
+		}
+		switch m.Type() {
+		case rfbSetPixelFormat:
+			if pf, _ := m.PixelFormat(); pf != broadcastPixelFormat {
+				return errors.New("unsupported pixel format for broadcast")
+			}
+			continue
+		case rfbFramebufferUpdateReq:
+			// late joiners need a full update, but incremental ones are
+			// already requested for everyone
+			if m[1] != 0 {
+				continue
+			}
+		case rfbKeyEvent, rfbPointerEvent:
+			if !g.IsController(v) {
+				continue
+			}
+		case rfbClientCutText:
+			if !g.IsController(v) {
+				continue
+			}
+			if text, extended, _ := m.CutText(); extended || !v.p.allowClipboard(true, text) {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := g.send(m); err != nil {
+			return err
+		}
+		count(len(m))
+	}
+}
+
+// copyToViewer writes the queued messages to a viewer until the viewer falls
+// behind, the upstream connection ends, or stop is closed.
+func (g *broadcastGroup) copyToViewer(v *broadcastViewer, c io.Writer, stop <-chan struct{}) error {
+	for {
+		select {
+		case m := <-v.ch:
+			if text, extended, ok := m.CutText(); ok && (extended || !v.p.allowClipboard(false, text)) {
+				continue
+			}
+			if _, err := c.Write(m); err != nil {
+				return err
+			}
+		case <-v.gone:
+			return errBroadcastSlow
+		case <-g.done:
+			return io.EOF
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// broadcastHandler returns an http.Handler which adds websocket connections as
+// viewers of the broadcast group for t, using p for the viewer's restrictions.
+func broadcastHandler(t *target, p rfbProxy) http.Handler {
+	return websocket.Server{
+		Handshake: wsProxyHandshake,
+		Handler:   wsBroadcastHandler(t.Name, t.addr(), t.dialer(), p, t.canControl),
+	}
+}
+
+// wsBroadcastHandler is a websocket.Handler which adds the connection as a
+// viewer of the broadcast group for the named target.
+func wsBroadcastHandler(name, to string, dial dialFunc, p rfbProxy, canControl func(user string) bool) websocket.Handler {
+	return func(ws *websocket.Conn) {
+		r := ws.Request()
+		if requestSessionID(r) == "" {
+			r = withSessionID(r, newSessionID())
+		}
+
+		label := requestTarget(r)
+		metricUpgrades.WithLabelValues(label).Inc()
+
+		v := &broadcastViewer{
+			r:          r,
+			p:          p,
+			canControl: !p.ViewOnly && canControl(requestUser(r)),
+			ch:         make(chan rfbServerMessage, broadcastQueue),
+			gone:       make(chan struct{}),
+		}
+
+		s := &session{
+			ID:     requestSessionID(r),
+			Client: r.RemoteAddr,
+			User:   requestUser(r),
+			Target: to,
+			Start:  time.Now(),
+			close: func() {
+				ws.Close()
+			},
+		}
+		if err := sessions.Add(s); err != nil {
+			metricRejected.WithLabelValues(rejectShuttingDown).Inc()
+			ws.Close()
+			return
+		}
+		defer sessions.Remove(s)
+
+		g, err := broadcasts.Join(name, to, dial, p, v)
+		if err != nil {
+			logr(r, levelWarn, "error connecting to broadcast %#v for %s: %v\n", name, requestWho(r), err)
+			var f *rfbFailure
+			if errors.As(err, &f) {
+				ws.PayloadType = websocket.BinaryFrame
+				rfbRefuse(rfbConn{bufio.NewReader(ws), ws}, f.Reason)
+			}
+			ws.Close()
+			return
+		}
+		defer broadcasts.Leave(g, v)
+
+		metricActiveSessions.WithLabelValues(label).Inc()
+		defer metricActiveSessions.WithLabelValues(label).Dec()
+		defer func() {
+			metricSessionDuration.WithLabelValues(label).Observe(time.Since(s.Start).Seconds())
+		}()
+
+		ws.PayloadType = websocket.BinaryFrame
+
+		toServer := metricBytes.WithLabelValues(label, "to_server")
+		toClient := metricBytes.WithLabelValues(label, "to_client")
+
+		rec, err := recordings.Start(s)
+		if err != nil {
+			logr(r, levelError, "error starting recording for %s: %v.\n", requestWho(r), err)
+		} else if rec != nil {
+			logr(r, levelInfo, "recording %s to %s\n", requestWho(r), rec.Filename())
+		}
+
+		var cr io.Reader = ws
+		if rec != nil {
+			cr = teeReader{ws, func(p []byte) {
+				rec.Record(recToServer, p)
+			}}
+		}
+		c := rfbConn{bufio.NewReader(cr), teeWriter{ws, func(p []byte) {
+			s.CountToClient(len(p))
+			toClient.Add(float64(len(p)))
+			if rec != nil {
+				rec.Record(recToClient, p)
+			}
+		}}}
+
+		if err := rfbServerHandshake(c.Reader, c, g.ServerInit()); err != nil {
+			logr(r, levelInfo, "handshake with broadcast %#v failed for %s: %v\n", name, requestWho(r), err)
+		} else {
+			logr(r, levelInfo, "joined broadcast %#v for %s (%d viewers)\n", name, requestWho(r), broadcasts.Len(name, to))
+
+			done, stop := make(chan error), make(chan struct{})
+			go func() {
+				done <- g.copyViewer(v, c.Reader, func(n int) {
+					s.CountToServer(n)
+					toServer.Add(float64(n))
+				})
+			}()
+			go func() {
+				done <- g.copyToViewer(v, c, stop)
+			}()
+
+			if err := <-done; err == errBroadcastSlow {
+				logr(r, levelWarn, "%s: %v\n", requestWho(r), err)
+			} else if err != nil {
+				logr(r, levelDebug, "%s: %v\n", requestWho(r), err)
+			}
+			ws.Close()
+			close(stop)
+			<-done
+		}
+		logr(r, levelInfo, "left broadcast %#v for %s after %s\n", name, requestWho(r), time.Since(s.Start).Round(time.Second))
+
+		ws.Close()
+
+		if rec != nil {
+			if err := rec.Close(); err != nil {
+				logr(r, levelError, "recording %s is incomplete: %v.\n", rec.Filename(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestBroadcast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	type upstreamConn struct {
+		net.Conn
+		r *bufio.Reader
+	}
+	upstream := make(chan upstreamConn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.SetDeadline(time.Now().Add(time.Second * 10))
+			r := bufio.NewReader(c)
+			if err := rfbServerHandshake(r, c, testServerInit); err != nil {
+				panic(err)
+			}
+			upstream <- upstreamConn{c, r}
+		}
+	}()
+
+	s := httptest.NewServer(websocket.Server{
+		Handshake: wsProxyHandshake,
+		Handler: wsBroadcastHandler("test", addr, tcpDialer(addr), rfbProxy{}, func(user string) bool {
+			return true
+		}),
+	})
+	defer s.Close()
+
+	dial := func(name string) (*websocket.Conn, *bufio.Reader) {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http"), "binary", s.URL)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		br := bufio.NewReader(ws)
+		expectRead(t, name+": version", br, []byte("RFB 003.008\n"))
+		ws.Write([]byte("RFB 003.008\n"))
+		expectRead(t, name+": security types", br, []byte{1, rfbSecNone})
+		ws.Write([]byte{rfbSecNone})
+		expectRead(t, name+": security result", br, []byte{0, 0, 0, 0})
+		ws.Write([]byte{1})
+
+		si := append([]byte(nil), testServerInit...)
+		copy(si[4:20], broadcastPixelFormat[:])
+		expectRead(t, name+": server init", br, si)
+		return ws, br
+	}
+
+	var u upstreamConn
+	expectUpstream := func(what string, typ uint8, check func(m rfbClientMessage) bool) {
+		m, err := readRFBClientMessage(u.r)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", what, err)
+		}
+		if m.Type() != typ || (check != nil && !check(m)) {
+			t.Fatalf("%s: unexpected message %v", what, m)
+		}
+	}
+	incremental := func(m rfbClientMessage) bool { return m[1] != 0 }
+	full := func(m rfbClientMessage) bool { return m[1] == 0 }
+
+	update := join([]byte{rfbFramebufferUpdate, 0, 0, 1}, []byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}, []byte{1, 2, 3, 4})
+	key := []byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x61}
+
+	ws1, br1 := dial("viewer 1")
+	defer ws1.Close()
+
+	u = <-upstream
+	defer u.Close()
+	expectUpstream("pixel format", rfbSetPixelFormat, func(m rfbClientMessage) bool {
+		pf, _ := m.PixelFormat()
+		return pf == broadcastPixelFormat
+	})
+	expectUpstream("encodings", rfbSetEncodings, func(m rfbClientMessage) bool {
+		encs, _ := m.Encodings()
+		return reflect.DeepEqual(encs, []int32{rfbEncHextile, rfbEncRRE, rfbEncCoRRE, rfbEncRaw})
+	})
+	expectUpstream("initial update request", rfbFramebufferUpdateReq, full)
+
+	u.Write(update)
+	expectRead(t, "viewer 1: update", br1, update)
+	expectUpstream("next update request", rfbFramebufferUpdateReq, incremental)
+
+	ws2, br2 := dial("viewer 2")
+	defer ws2.Close()
+
+	// viewer 2 isn't in control, but can request a full update
+	ws2.Write(key)
+	ws2.Write([]byte{rfbFramebufferUpdateReq, 0, 0, 0, 0, 0, 0, 4, 0, 3})
+	expectUpstream("late joiner update request", rfbFramebufferUpdateReq, full)
+	ws1.Write(key)
+	expectUpstream("controller key", rfbKeyEvent, nil)
+
+	u.Write(update)
+	expectRead(t, "viewer 1: update", br1, update)
+	expectRead(t, "viewer 2: update", br2, update)
+	expectUpstream("next update request", rfbFramebufferUpdateReq, incremental)
+
+	select {
+	case <-upstream:
+		t.Fatalf("expected a single upstream connection")
+	default:
+	}
+
+	// control is passed on when the controller leaves
+	ws1.Close()
+	for i := 0; broadcasts.Len("test", addr) != 1; i++ {
+		if i == 100 {
+			t.Fatalf("expected viewer 1 to leave")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	ws2.Write(key)
+	expectUpstream("new controller key", rfbKeyEvent, nil)
+
+	// the upstream connection is closed when the last viewer leaves
+	ws2.Close()
+	if _, err := readRFBClientMessage(u.r); err != io.EOF {
+		t.Errorf("expected upstream connection to be closed, got %v", err)
+	}
+}
+
+func TestBroadcastController(t *testing.T) {
+	v1 := &broadcastViewer{r: httptest.NewRequest("GET", "/", nil), canControl: false}
+	v2 := &broadcastViewer{r: httptest.NewRequest("GET", "/", nil), canControl: true}
+	v3 := &broadcastViewer{r: httptest.NewRequest("GET", "/", nil), canControl: true}
+
+	br := newBroadcastRegistry()
+	g := &broadcastGroup{br: br}
+	for _, v := range []*broadcastViewer{v1, v2, v3} {
+		g.viewers = append(g.viewers, v)
+		br.updateController(g)
+	}
+	if !g.IsController(v2) {
+		t.Errorf("expected the first viewer which can control to be in control")
+	}
+
+	g.viewers = []*broadcastViewer{v1, v3}
+	br.updateController(g)
+	if !g.IsController(v3) {
+		t.Errorf("expected control to be passed to the next viewer")
+	}
+
+	g.viewers = []*broadcastViewer{v1}
+	br.updateController(g)
+	if g.IsController(v1) || g.controller != nil {
+		t.Errorf("expected nobody to be in control")
+	}
+}
+
+// expectRead reads len(exp) bytes from r and checks them.
+func expectRead(t *testing.T, what string, r io.Reader, exp []byte) {
+	t.Helper()
+	buf := make([]byte, len(exp))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("%s: unexpected error: %v", what, err)
+	}
+	if !bytes.Equal(buf, exp) {
+		t.Fatalf("%s: expected %v, got %v", what, exp, buf)
+	}
+}
@@ -0,0 +1,143 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// yamlLineErrorRegexp matches the line number in yaml syntax errors.
+var yamlLineErrorRegexp = regexp.MustCompile(`^yaml: line ([0-9]+): (.+)$`)
+
+// loadConfig sets flags from a YAML config file, where the keys are the long
+// flag names. Flags for which skip returns true (i.e. ones which were already
+// set from the command line or environment) are left as-is. Lists can be
+// specified as a YAML sequence or a comma-separated string, and key=value lists
+// (i.e. novnc-params) can also be specified as a mapping. Errors contain the
+// filename and line number. If set is not nil, it is called for each flag which
+// was set.
+func loadConfig(fs *pflag.FlagSet, fn string, skip func(*pflag.Flag) bool, set func(*pflag.Flag, string)) error {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(buf)).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		if m := yamlLineErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+			return fmt.Errorf("%s:%s: %s", fn, m[1], m[2])
+		}
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of option names to values", fn, root.Line)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+
+		name := k.Value
+		switch name {
+		case "config", "help":
+			return fmt.Errorf("%s:%d: option %#v cannot be set from a config file", fn, k.Line, name)
+		}
+
+		flag := fs.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("%s:%d: unknown option %#v", fn, k.Line, name)
+		}
+
+		if seen[name] {
+			return fmt.Errorf("%s:%d: duplicate option %#v", fn, k.Line, name)
+		}
+		seen[name] = true
+
+		sv, isSlice := flag.Value.(pflag.SliceValue)
+		if !isSlice && v.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s:%d: option %#v: expected a single value", fn, v.Line, name)
+		}
+
+		vals, err := configValues(v)
+		if err != nil {
+			return fmt.Errorf("%s:%d: option %#v: %v", fn, v.Line, name, err)
+		}
+
+		if isSlice && v.Kind == yaml.ScalarNode {
+			if vals[0] == "" {
+				vals = nil
+			} else {
+				vals = strings.Split(vals[0], ",")
+			}
+		}
+
+		if skip != nil && skip(flag) {
+			continue
+		}
+
+		if isSlice {
+			err = sv.Replace(vals)
+		} else {
+			err = flag.Value.Set(vals[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: option %#v: %v", fn, v.Line, name, err)
+		}
+
+		if set != nil {
+			set(flag, strings.Join(vals, ","))
+		}
+	}
+
+	return nil
+}
+
+// configValues converts a YAML node into a list of string values.
+func configValues(n *yaml.Node) ([]string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return []string{""}, nil
+		}
+		return []string{n.Value}, nil
+	case yaml.SequenceNode:
+		vals := make([]string, len(n.Content))
+		for i, c := range n.Content {
+			if c.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("list item %d: expected a scalar value", i+1)
+			}
+			vals[i] = c.Value
+		}
+		return vals, nil
+	case yaml.MappingNode:
+		vals := make([]string, 0, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode || v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("key %#v: expected a scalar value", k.Value)
+			}
+			vals = append(vals, k.Value+"="+v.Value)
+		}
+		return vals, nil
+	default:
+		return nil, fmt.Errorf("unsupported value")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfig(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	newFlagSet := func() (*pflag.FlagSet, map[string]interface{}) {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		return fs, map[string]interface{}{
+			"host":            fs.StringP("host", "h", "localhost", ""),
+			"port":            fs.Uint16P("port", "p", 5900, ""),
+			"addr":            fs.StringP("addr", "a", ":8080", ""),
+			"arbitrary-hosts": fs.Bool("arbitrary-hosts", false, ""),
+			"cidr-whitelist":  fs.StringSlice("cidr-whitelist", nil, ""),
+			"cidr-blacklist":  fs.StringSlice("cidr-blacklist", nil, ""),
+			"novnc-params":    fs.StringSlice("novnc-params", nil, ""),
+			"config":          fs.String("config", "", ""),
+		}
+	}
+
+	writeConfig := func(name, cfg string) string {
+		fn := filepath.Join(d, name)
+		if err := ioutil.WriteFile(fn, []byte(cfg), 0644); err != nil {
+			panic(err)
+		}
+		return fn
+	}
+
+	t.Run("Precedence", func(t *testing.T) {
+		fs, v := newFlagSet()
+		if err := fs.Parse([]string{"--host", "cli.example.com"}); err != nil {
+			panic(err)
+		}
+		fs.Lookup("port").Value.Set("1234") // from env
+
+		fn := writeConfig("precedence.yaml", strings.Join([]string{
+			"host: file.example.com",
+			"port: 5678",
+			"arbitrary-hosts: true",
+			"cidr-whitelist: [10.0.0.0/8, 192.168.0.0/16]",
+			"cidr-blacklist: 127.0.0.0/8,::1/128",
+			"novnc-params:",
+			"  resize: remote",
+			"  logging: debug",
+		}, "\n"))
+
+		if err := loadConfig(fs, fn, func(f *pflag.Flag) bool {
+			return f.Changed || f.Name == "port"
+		}, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for name, exp := range map[string]interface{}{
+			"host":            "cli.example.com",
+			"port":            uint16(1234),
+			"addr":            ":8080",
+			"arbitrary-hosts": true,
+			"cidr-whitelist":  []string{"10.0.0.0/8", "192.168.0.0/16"},
+			"cidr-blacklist":  []string{"127.0.0.0/8", "::1/128"},
+			"novnc-params":    []string{"resize=remote", "logging=debug"},
+		} {
+			if act := reflect.ValueOf(v[name]).Elem().Interface(); !reflect.DeepEqual(act, exp) {
+				t.Errorf("expected %s to be %#v, got %#v", name, exp, act)
+			}
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		fs, v := newFlagSet()
+		if err := loadConfig(fs, writeConfig("empty.yaml", "# nothing\n"), nil, nil); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if h := *v["host"].(*string); h != "localhost" {
+			t.Errorf("expected default host, got %#v", h)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, c := range []struct {
+			Config string
+			Error  string
+		}{
+			{"host: test\nport: [1, 2]\n", "errors.yaml:2: option \"port\": expected a single value"},
+			{"host: test\nport: abc\n", "errors.yaml:2: option \"port\""},
+			{"host: test\n\nunknown: true\n", "errors.yaml:3: unknown option \"unknown\""},
+			{"host: test\nhost: test\n", "errors.yaml:2: duplicate option \"host\""},
+			{"host: test\nconfig: other.yaml\n", "errors.yaml:2: option \"config\" cannot be set"},
+			{"host: test\n  port: 1\n", "errors.yaml:2:"},
+			{"- host\n", "errors.yaml:1: expected a mapping"},
+			{"cidr-whitelist: [[a]]\n", "errors.yaml:1: option \"cidr-whitelist\": list item 1"},
+		} {
+			fs, _ := newFlagSet()
+			err := loadConfig(fs, writeConfig("errors.yaml", c.Config), nil, nil)
+			if err == nil {
+				t.Errorf("expected error for %#v", c.Config)
+			} else if !strings.Contains(err.Error(), c.Error) {
+				t.Errorf("expected error for %#v to contain %#v, got %#v", c.Config, c.Error, err.Error())
+			}
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		fs, _ := newFlagSet()
+		if err := loadConfig(fs, filepath.Join(d, "nonexistent.yaml"), nil, nil); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
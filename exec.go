@@ -0,0 +1,272 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultExecTimeout is how long to wait for the VNC server started by an exec
+// target to accept connections if the target doesn't specify a timeout.
+const defaultExecTimeout = time.Second * 30
+
+// defaultExecGrace is how long processes started by an exec target are given
+// to exit after the session ends before they are killed if the target doesn't
+// specify a grace period.
+const defaultExecGrace = time.Second * 5
+
+// execDisplayMin is the first X display number allocated for exec targets.
+const execDisplayMin = 10
+
+// execDisplays contains the X display numbers in use by exec targets.
+var execDisplays = &execDisplayAllocator{used: map[int]bool{}}
+
+// renderExecCommand renders the command template for an exec target, which
+// can use {{display}} and {{port}}.
+func renderExecCommand(command string, display, port int) (string, error) {
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"display": func() int { return display },
+		"port":    func() int { return port },
+	}).Parse(command)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// execDisplayAllocator allocates X display numbers which aren't in use.
+type execDisplayAllocator struct {
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// Get allocates a display number which isn't in use by another exec target or
+// an existing X server.
+func (a *execDisplayAllocator) Get() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for n := execDisplayMin; n < execDisplayMin+1000; n++ {
+		if a.used[n] {
+			continue
+		}
+		if _, err := os.Stat(fmt.Sprintf("/tmp/.X%d-lock", n)); err == nil {
+			continue
+		}
+		if _, err := os.Stat(fmt.Sprintf("/tmp/.X11-unix/X%d", n)); err == nil {
+			continue
+		}
+		a.used[n] = true
+		return n, nil
+	}
+	return 0, errors.New("no free X displays")
+}
+
+// Put releases a display number.
+func (a *execDisplayAllocator) Put(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.used, n)
+}
+
+// freePort returns a local TCP port which isn't in use.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// execDialer returns a dialFunc which starts a VNC server for each connection
+// by running the rendered command template with sh, waits up to timeout for it
+// to accept connections, and connects to it. The processes are killed when the
+// connection is closed, or after the grace period if they don't exit.
+func execDialer(name, tmpl string, timeout, grace time.Duration) dialFunc {
+	return func(r *http.Request) (net.Conn, error) {
+		display, err := execDisplays.Get()
+		if err != nil {
+			return nil, err
+		}
+		port, err := freePort()
+		if err != nil {
+			execDisplays.Put(display)
+			return nil, fmt.Errorf("allocate port: %w", err)
+		}
+		command, err := renderExecCommand(tmpl, display, port)
+		if err != nil {
+			execDisplays.Put(display)
+			return nil, fmt.Errorf("render command: %w", err)
+		}
+
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"EASY_NOVNC_TARGET="+name,
+			"EASY_NOVNC_USER="+requestUser(r),
+			"EASY_NOVNC_SESSION="+requestSessionID(r),
+		)
+		cmd.Stdout = &execLogWriter{r: r}
+		cmd.Stderr = cmd.Stdout
+		setProcessGroup(cmd)
+
+		if err := cmd.Start(); err != nil {
+			execDisplays.Put(display)
+			return nil, fmt.Errorf("start command: %w", err)
+		}
+		logr(r, levelInfo, "started %q (pid %d) for %s\n", command, cmd.Process.Pid, requestWho(r))
+
+		p := &execProcess{
+			r:      r,
+			cmd:    cmd,
+			exited: make(chan struct{}),
+		}
+		go func() {
+			p.err = cmd.Wait()
+			close(p.exited)
+			execDisplays.Put(display)
+			logr(r, levelDebug, "command for %s exited: %v\n", requestWho(r), p.err)
+		}()
+
+		conn, err := p.dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), timeout)
+		if err != nil {
+			p.Kill(grace)
+			return nil, err
+		}
+		return &execConn{Conn: conn, p: p, grace: grace}, nil
+	}
+}
+
+// execProcess is a process started by an exec target.
+type execProcess struct {
+	r   *http.Request
+	cmd *exec.Cmd
+
+	exited chan struct{}
+	err    error // set before exited is closed
+}
+
+// dial waits for the VNC server to accept connections on addr and start with
+// the RFB magic, then returns the connection. Since some servers (e.g. x11vnc
+// without -forever) exit after the first client disconnects, the connection
+// used to check the server is the one which is returned.
+func (p *execProcess) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-p.exited:
+			// if the shell exited successfully, the server may have been
+			// started in the background
+			if p.err != nil {
+				return nil, fmt.Errorf("command exited before accepting connections: %v", p.err)
+			}
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.SetReadDeadline(deadline)
+			br := bufio.NewReader(conn)
+			magic, err := br.Peek(3)
+			if err == nil && string(magic) == "RFB" {
+				conn.SetReadDeadline(time.Time{})
+				return &bufferedConn{conn, br}, nil
+			}
+			conn.Close()
+			if err == nil {
+				return nil, fmt.Errorf("not a VNC server (got %q)", magic)
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("VNC server didn't start within %s", timeout)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// Kill asks the process group to exit, then kills whatever is left of it
+// after the grace period (even if the shell exited, background processes may
+// still be running).
+func (p *execProcess) Kill(grace time.Duration) {
+	killProcessGroup(p.cmd, false)
+	go func() {
+		t := time.NewTimer(grace)
+		select {
+		case <-p.exited:
+			<-t.C
+		case <-t.C:
+			logr(p.r, levelWarn, "command for %s didn't exit within %s, killing it\n", requestWho(p.r), grace)
+		}
+		killProcessGroup(p.cmd, true)
+	}()
+}
+
+// execConn is a connection to a VNC server started by an exec target, which
+// stops the server when closed.
+type execConn struct {
+	net.Conn
+	p     *execProcess
+	grace time.Duration
+	once  sync.Once
+}
+
+func (c *execConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		logr(c.p.r, levelInfo, "stopping command (pid %d) for %s\n", c.p.cmd.Process.Pid, requestWho(c.p.r))
+		c.p.Kill(c.grace)
+	})
+	return err
+}
+
+// bufferedConn is a net.Conn which reads through a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// execLogWriter logs the output of a command at the debug level, line by line.
+type execLogWriter struct {
+	r   *http.Request
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *execLogWriter) Write(buf []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, buf...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		if line := strings.TrimSpace(string(w.buf[:i])); line != "" {
+			logr(w.r, levelDebug, "command output: %s\n", line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > 4096 {
+		logr(w.r, levelDebug, "command output: %s\n", w.buf)
+		w.buf = w.buf[:0]
+	}
+	return len(buf), nil
+}
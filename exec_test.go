@@ -0,0 +1,88 @@
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderExecCommand(t *testing.T) {
+	if cmd, err := renderExecCommand("Xvfb :{{display}} & x11vnc -display :{{display}} -rfbport {{port}}", 10, 5910); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if exp := "Xvfb :10 & x11vnc -display :10 -rfbport 5910"; cmd != exp {
+		t.Errorf("expected %q, got %q", exp, cmd)
+	}
+	for _, c := range []string{"{{user}}", "{{display", "{{port 1}}"} {
+		if _, err := renderExecCommand(c, 10, 5910); err == nil {
+			t.Errorf("%q: expected error", c)
+		}
+	}
+}
+
+func TestExecDialer(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	helper := "EASY_NOVNC_TEST_EXEC=1 " + strconv.Quote(os.Args[0]) + " -test.run=TestExecHelperProcess -- {{port}}"
+
+	conn, err := execDialer("test", helper, time.Second*10, time.Second)(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr := conn.(*execConn).Conn.RemoteAddr().String()
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if string(buf) != "RFB 003.008\n" {
+		t.Errorf("expected the version to be read from the connection, got %q", buf)
+	}
+	conn.Close()
+
+	// the server should be stopped
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i == 50 {
+			t.Fatalf("expected the command to be stopped")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if _, err := execDialer("test", "exit 1", time.Second*10, time.Second)(r); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("expected command exit error, got %v", err)
+	}
+
+	n := time.Now()
+	if _, err := execDialer("test", "sleep 10", time.Millisecond*300, time.Millisecond*100)(r); err == nil || !strings.Contains(err.Error(), "didn't start") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(n); d > time.Second*2 {
+		t.Errorf("expected dial to give up after the timeout, took %s", d)
+	}
+}
+
+// TestExecHelperProcess is a fake VNC server started by TestExecDialer.
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv("EASY_NOVNC_TEST_EXEC") == "" {
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:"+os.Args[len(os.Args)-1])
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		c.Write([]byte("RFB 003.008\n"))
+	}
+}
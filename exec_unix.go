@@ -0,0 +1,30 @@
+// +build !index_generate
+// +build !novnc_generate
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command start a new process group, so it can be
+// killed along with any processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// execSupported is whether exec targets can be used on this platform.
+const execSupported = true
+
+// killProcessGroup sends SIGTERM (or SIGKILL if force is true) to the process
+// group of a command started with setProcessGroup. Errors are ignored, since
+// the group may already be gone (ESRCH).
+func killProcessGroup(cmd *exec.Cmd, force bool) {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,21 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"os/exec"
+)
+
+// execSupported is whether exec targets can be used on this platform. The
+// commands are run with /bin/sh, and process groups can't be killed.
+const execSupported = false
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command. On Windows, processes started by it
+// aren't killed, and it can't be asked to exit gracefully.
+func killProcessGroup(cmd *exec.Cmd, force bool) {
+	cmd.Process.Kill()
+}
@@ -4,10 +4,13 @@ go 1.14
 
 require (
 	github.com/gorilla/mux v1.7.4
+	github.com/prometheus/client_golang v1.7.0
 	github.com/shurcooL/httpfs v0.0.0-20190707220628-8d4bc4ba7749
 	github.com/shurcooL/vfsgen v0.0.0-20181202132449-6a9ea43bcacd
 	github.com/spf13/pflag v1.0.5
 	github.com/spkg/zipfs v0.7.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 	golang.org/x/tools v0.0.0-20200302213018-c4f5635f1074 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,297 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdListenAddr is the listen address for sockets passed by systemd socket
+// activation. It can be followed by a colon and the FileDescriptorName of the
+// socket.
+const systemdListenAddr = "systemd"
+
+// systemdFiles contains the sockets passed by systemd which haven't been used
+// yet.
+var systemdFiles struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files []*os.File
+	err   error
+}
+
+// listenAddr is a listen address with per-listener options, parsed from
+// addr?key=value&key=value.
+type listenAddr struct {
+	Addr    string
+	TLSCert string   // tls-cert
+	TLSKey  string   // tls-key
+	NoTLS   bool     // tls=off
+	Allow   []string // allow (can be repeated)
+}
+
+// parseListenAddr parses a listen address with optional per-listener options.
+func parseListenAddr(s string) (listenAddr, error) {
+	var la listenAddr
+	la.Addr = s
+	if i := strings.IndexByte(s, '?'); i != -1 {
+		la.Addr = s[:i]
+		q, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return la, fmt.Errorf("parse listener options: %w", err)
+		}
+		for k, v := range q {
+			switch k {
+			case "tls-cert":
+				la.TLSCert = v[len(v)-1]
+			case "tls-key":
+				la.TLSKey = v[len(v)-1]
+			case "tls":
+				switch v[len(v)-1] {
+				case "on":
+				case "off":
+					la.NoTLS = true
+				default:
+					return la, fmt.Errorf("tls must be on or off, got %#v", v[len(v)-1])
+				}
+			case "allow":
+				la.Allow = append(la.Allow, v...)
+			default:
+				return la, fmt.Errorf("unknown listener option %#v", k)
+			}
+		}
+	}
+	if la.Addr == "" {
+		return la, errors.New("address is required")
+	}
+	if path, ok := unixSocketPath(la.Addr); ok {
+		if err := checkUnixSocketPath(path); err != nil {
+			return la, err
+		}
+		if len(la.Allow) != 0 {
+			return la, errors.New("allow can't be used with unix sockets")
+		}
+	}
+	if (la.TLSCert == "") != (la.TLSKey == "") {
+		return la, errors.New("tls-cert and tls-key must be specified together")
+	}
+	if la.NoTLS && la.TLSCert != "" {
+		return la, errors.New("tls=off conflicts with tls-cert")
+	}
+	if _, err := parseCIDRList(la.Allow); err != nil {
+		return la, err
+	}
+	return la, nil
+}
+
+// allowListener is a net.Listener which closes connections from IPs which
+// aren't in a whitelist.
+type allowListener struct {
+	net.Listener
+	allow []*net.IPNet
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if remoteAddrInCIDRList(c.RemoteAddr().String(), l.allow) {
+			return c, nil
+		}
+		logf(levelDebug, "rejected connection from %s on %s (not in allow list)\n", c.RemoteAddr(), l.Addr())
+		metricRejected.WithLabelValues(rejectListenerAllow).Inc()
+		c.Close()
+	}
+}
+
+// listen creates a listener for addr, which is either a tcp host:port, a unix
+// socket (unix:/path) created with mode and owner (if not zero or empty), or a
+// socket passed by systemd (systemd or systemd:name).
+func listen(addr string, mode os.FileMode, owner string) (net.Listener, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return listenUnix(path, mode, owner)
+	}
+	if addr == systemdListenAddr {
+		return listenSystemd("")
+	}
+	if name := strings.TrimPrefix(addr, systemdListenAddr+":"); name != addr {
+		return listenSystemd(name)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenAddrString returns a description of a listener's address for log
+// messages, where scheme is http or https.
+func listenAddrString(scheme string, l net.Listener) string {
+	if a := l.Addr(); a.Network() == "unix" {
+		return fmt.Sprintf("unix:%s (%s)", a, scheme)
+	}
+	return fmt.Sprintf("%s://%s", scheme, l.Addr())
+}
+
+// listenUnix creates a unix socket at path, replacing a stale one if it
+// exists, and sets the mode and owner.
+func listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	if err := checkUnixSocketPath(path); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix %s: file exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listen unix %s: remove stale socket: %w", path, err)
+		}
+	}
+	var l net.Listener
+	var err error
+	if mode != 0 {
+		// so it can't be connected to before the chmod
+		l, err = listenUnixPrivate(path)
+	} else {
+		l, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listen unix %s: %w", path, err)
+		}
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listen unix %s: set owner: %w", path, err)
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner parses an owner in the form user, user:group, or :group, where
+// the user and group can be names or ids. The uid or gid is -1 if not
+// specified.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	spl := strings.SplitN(owner, ":", 2)
+	if spl[0] != "" {
+		u, err := user.Lookup(spl[0])
+		if err != nil {
+			if u, err = user.LookupId(spl[0]); err != nil {
+				return -1, -1, err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, fmt.Errorf("unsupported uid %#v", u.Uid)
+		}
+	}
+	if len(spl) == 2 && spl[1] != "" {
+		g, err := user.LookupGroup(spl[1])
+		if err != nil {
+			if g, err = user.LookupGroupId(spl[1]); err != nil {
+				return -1, -1, err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return -1, -1, fmt.Errorf("unsupported gid %#v", g.Gid)
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return -1, -1, fmt.Errorf("invalid owner %#v", owner)
+	}
+	return uid, gid, nil
+}
+
+// listenSystemd returns a listener for the next unused socket passed by
+// systemd, or the one with the specified name.
+func listenSystemd(name string) (net.Listener, error) {
+	systemdFiles.once.Do(func() {
+		var n int
+		var names []string
+		if n, names, systemdFiles.err = parseSystemdEnv(os.Getenv, os.Getpid()); systemdFiles.err == nil {
+			for i := 0; i < n; i++ {
+				systemdFiles.files = append(systemdFiles.files, os.NewFile(uintptr(3+i), names[i]))
+			}
+		}
+		// so child processes (e.g. exec targets) don't inherit them
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemdFiles.err != nil {
+		return nil, systemdFiles.err
+	}
+
+	systemdFiles.mu.Lock()
+	defer systemdFiles.mu.Unlock()
+
+	for i, f := range systemdFiles.files {
+		if f == nil || (name != "" && f.Name() != name) {
+			continue
+		}
+		systemdFiles.files[i] = nil
+		defer f.Close()
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("listen systemd socket %#v: %w", f.Name(), err)
+		}
+		return l, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("no unused socket named %#v passed by systemd (LISTEN_FDNAMES)", name)
+	}
+	return nil, errors.New("no unused sockets passed by systemd (LISTEN_FDS)")
+}
+
+// parseSystemdEnv parses the environment variables set by systemd for socket
+// activation (see sd_listen_fds(3)), and returns the number of sockets (passed
+// as fds starting from 3) and their names.
+func parseSystemdEnv(getenv func(string) string, pid int) (int, []string, error) {
+	if getenv("LISTEN_PID") == "" || getenv("LISTEN_FDS") == "" {
+		return 0, nil, errors.New("no sockets passed by systemd (LISTEN_PID and LISTEN_FDS not set)")
+	}
+	if p, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil {
+		return 0, nil, fmt.Errorf("parse LISTEN_PID: %w", err)
+	} else if p != pid {
+		return 0, nil, fmt.Errorf("sockets passed by systemd are for pid %d, not %d", p, pid)
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("parse LISTEN_FDS: %w", err)
+	} else if n < 1 {
+		return 0, nil, errors.New("no sockets passed by systemd (LISTEN_FDS < 1)")
+	}
+	names := make([]string, n)
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		spl := strings.Split(v, ":")
+		if len(spl) != n {
+			return 0, nil, fmt.Errorf("expected %d names in LISTEN_FDNAMES, got %d", n, len(spl))
+		}
+		copy(names, spl)
+	} else {
+		for i := range names {
+			names[i] = "unknown"
+		}
+	}
+	return n, names, nil
+}
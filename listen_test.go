@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	path := filepath.Join(d, "easy-novnc.sock")
+
+	// stale socket
+	if l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"}); err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	} else {
+		l.SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	l, err := listen("unix:"+path, 0600, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := listenAddrString("http", l); s != "unix:"+path+" (http)" {
+		t.Errorf("unexpected addr string %q", s)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %s", fi.Mode().Perm())
+	}
+
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("test"))
+			c.Close()
+		}
+	}()
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else {
+		expectRead(t, "unix socket", c, []byte("test"))
+		c.Close()
+	}
+
+	if _, err := listen("unix:"+path, 0, ""); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("expected in use error, got %v", err)
+	}
+
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed on close, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		panic(err)
+	}
+	if _, err := listen("unix:"+path, 0, ""); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("expected not a socket error, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected file to be left alone, got %v", err)
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	for _, c := range []struct {
+		Owner    string
+		UID, GID string
+	}{
+		{u.Username, u.Uid, "-1"},
+		{u.Uid, u.Uid, "-1"},
+		{":" + u.Gid, "-1", u.Gid},
+		{u.Username + ":" + u.Gid, u.Uid, u.Gid},
+	} {
+		uid, gid, err := lookupOwner(c.Owner)
+		if err != nil {
+			if strings.Contains(err.Error(), "not implemented") {
+				t.Skipf("user lookup not supported: %v", err)
+			}
+			t.Errorf("%s: unexpected error: %v", c.Owner, err)
+		} else if s := []string{strconv.Itoa(uid), strconv.Itoa(gid)}; !reflect.DeepEqual(s, []string{c.UID, c.GID}) {
+			t.Errorf("%s: expected %s:%s, got %s", c.Owner, c.UID, c.GID, strings.Join(s, ":"))
+		}
+	}
+	for _, c := range []string{"", ":", "easy-novnc-nonexistent-user", ":easy-novnc-nonexistent-group"} {
+		if _, _, err := lookupOwner(c); err == nil {
+			t.Errorf("%#v: expected error", c)
+		}
+	}
+}
+
+func TestParseSystemdEnv(t *testing.T) {
+	for _, c := range []struct {
+		Env   map[string]string
+		N     int
+		Names []string
+	}{
+		{map[string]string{}, 0, nil},
+		{map[string]string{"LISTEN_PID": "2", "LISTEN_FDS": "1"}, 0, nil},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "0"}, 0, nil},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "x"}, 0, nil},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http"}, 0, nil},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, 1, []string{"unknown"}},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http:https"}, 2, []string{"http", "https"}},
+	} {
+		n, names, err := parseSystemdEnv(func(k string) string { return c.Env[k] }, 1)
+		if c.N == 0 {
+			if err == nil {
+				t.Errorf("%v: expected error", c.Env)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error: %v", c.Env, err)
+		} else if n != c.N || !reflect.DeepEqual(names, c.Names) {
+			t.Errorf("%v: expected %d %v, got %d %v", c.Env, c.N, c.Names, n, names)
+		}
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	for _, c := range []struct {
+		Addr string
+		Exp  listenAddr
+	}{
+		{":8080", listenAddr{Addr: ":8080"}},
+		{"[::1]:8443?tls-cert=/etc/cert.pem&tls-key=/etc/key.pem", listenAddr{Addr: "[::1]:8443", TLSCert: "/etc/cert.pem", TLSKey: "/etc/key.pem"}},
+		{"10.0.0.1:8080?tls=off&allow=10.0.0.0/8&allow=fd00::/8", listenAddr{Addr: "10.0.0.1:8080", NoTLS: true, Allow: []string{"10.0.0.0/8", "fd00::/8"}}},
+		{"unix:/run/easy-novnc.sock?tls=off", listenAddr{Addr: "unix:/run/easy-novnc.sock", NoTLS: true}},
+		{"systemd:web?tls=on", listenAddr{Addr: "systemd:web"}},
+	} {
+		if la, err := parseListenAddr(c.Addr); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.Addr, err)
+		} else if !reflect.DeepEqual(la, c.Exp) {
+			t.Errorf("%s: expected %+v, got %+v", c.Addr, c.Exp, la)
+		}
+	}
+	for _, c := range []string{
+		"",
+		"?tls=off",
+		":8080?tls=maybe",
+		":8080?tls-key=/etc/key.pem",
+		":8080?tls=off&tls-cert=/etc/cert.pem&tls-key=/etc/key.pem",
+		":8080?allow=10.0.0.1",
+		":8080?allow=%zz",
+		":8080?port=1",
+		"unix:run/easy-novnc.sock",
+		"unix:/run/easy-novnc.sock?allow=10.0.0.0/8",
+	} {
+		if _, err := parseListenAddr(c); err == nil {
+			t.Errorf("%s: expected error", c)
+		}
+	}
+}
+
+func TestAllowListener(t *testing.T) {
+	for _, c := range []struct {
+		Allow   string
+		Allowed bool
+	}{
+		{"10.0.0.0/8", false},
+		{"127.0.0.0/8", true},
+	} {
+		tl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+
+		accepted := make(chan bool, 1)
+		go func(l net.Listener) {
+			conn, err := l.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err == nil
+		}(allowListener{tl, mustParseCIDRList(c.Allow)})
+
+		conn, err := net.Dial("tcp", tl.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: expected connection to be closed, got %v", c.Allow, err)
+		}
+		conn.Close()
+
+		// the accept loop only returns for allowed connections (or errors)
+		select {
+		case ok := <-accepted:
+			if !ok || !c.Allowed {
+				t.Errorf("%s: expected connection to be allowed=%t", c.Allow, c.Allowed)
+			}
+		case <-time.After(time.Millisecond * 100):
+			if c.Allowed {
+				t.Errorf("%s: expected connection to be allowed", c.Allow)
+			}
+		}
+		tl.Close()
+	}
+}
@@ -0,0 +1,25 @@
+// +build !index_generate
+// +build !novnc_generate
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes changes to the process umask.
+var umaskMu sync.Mutex
+
+// listenUnixPrivate creates a unix socket which is only accessible by the
+// current user, so it can't be connected to before its mode is set. Since the
+// umask is process-wide, it is only changed while the socket is created.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,38 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixPrivate(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	path := filepath.Join(d, "test.sock")
+	l, err := listenUnixPrivate(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("expected socket to only be accessible by the owner, got %s", fi.Mode().Perm())
+	}
+	if m := syscall.Umask(0); m != 0 {
+		t.Errorf("expected umask to be restored, got %#o", m)
+	}
+}
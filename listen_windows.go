@@ -0,0 +1,14 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"net"
+)
+
+// listenUnixPrivate creates a unix socket. On Windows, the socket mode isn't
+// used for access control, so there's nothing to restrict.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,160 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// parseLogLevel parses a log level name.
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %#v (expected debug, info, warn, or error)", s)
+	}
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// logger writes leveled log messages as text or JSON lines.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	level logLevel
+	now   func() time.Time
+}
+
+// stdLogger is the logger used by logf and logr.
+var stdLogger = &logger{w: os.Stdout, level: levelInfo, now: time.Now}
+
+// Configure sets the format and minimum level.
+func (l *logger) Configure(isJSON bool, level logLevel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.json, l.level = isJSON, level
+}
+
+// Log writes a message with optional key-value fields (which are only included
+// in JSON output, except for the session ID).
+func (l *logger) Log(level logLevel, fields []logField, format string, a ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+	t := l.now()
+
+	buf := new(bytes.Buffer)
+	if l.json {
+		buf.WriteByte('{')
+		writeJSONField(buf, "time", t.Format(time.RFC3339Nano))
+		buf.WriteByte(',')
+		writeJSONField(buf, "level", level.String())
+		buf.WriteByte(',')
+		writeJSONField(buf, "msg", msg)
+		for _, f := range fields {
+			if f.Value != "" {
+				buf.WriteByte(',')
+				writeJSONField(buf, f.Key, f.Value)
+			}
+		}
+		buf.WriteByte('}')
+	} else {
+		buf.WriteString(t.Format("Jan 02 15:04:05"))
+		buf.WriteString(": ")
+		for _, f := range fields {
+			if f.Key == "session" && f.Value != "" {
+				fmt.Fprintf(buf, "[%s] ", f.Value)
+			}
+		}
+		switch level {
+		case levelWarn:
+			buf.WriteString("Warning: ")
+		case levelError:
+			buf.WriteString("Error: ")
+		}
+		buf.WriteString(msg)
+	}
+	buf.WriteByte('\n')
+
+	l.w.Write(buf.Bytes())
+}
+
+// logField is a key-value pair for structured log messages.
+type logField struct {
+	Key   string
+	Value string
+}
+
+func writeJSONField(buf *bytes.Buffer, k, v string) {
+	kb, _ := json.Marshal(k)
+	vb, _ := json.Marshal(v)
+	buf.Write(kb)
+	buf.WriteByte(':')
+	buf.Write(vb)
+}
+
+// logf logs a message at the specified level.
+func logf(level logLevel, format string, a ...interface{}) {
+	stdLogger.Log(level, nil, format, a...)
+}
+
+// logr logs a message at the specified level, including the session ID,
+// client, user, and target for the request.
+func logr(r *http.Request, level logLevel, format string, a ...interface{}) {
+	stdLogger.Log(level, requestLogFields(r), format, a...)
+}
+
+// requestLogFields returns the log fields for a request.
+func requestLogFields(r *http.Request) []logField {
+	return []logField{
+		{"session", requestSessionID(r)},
+		{"client", r.RemoteAddr},
+		{"user", requestUser(r)},
+		{"target", requestTarget(r)},
+	}
+}
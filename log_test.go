@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now := func() time.Time {
+		return time.Date(2020, 6, 1, 15, 4, 5, 0, time.UTC)
+	}
+
+	r := httptest.NewRequest("GET", "/vnc", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r = withSessionID(withTarget(withUser(r, "user"), targetLabelDefault), "0123456789abcdef")
+
+	t.Run("Text", func(t *testing.T) {
+		for _, c := range []struct {
+			Level  logLevel
+			Fields []logField
+			Format string
+			Args   []interface{}
+			Out    string
+		}{
+			{levelDebug, nil, "test\n", nil, ""},
+			{levelInfo, nil, "test\n", nil, "Jun 01 15:04:05: test\n"},
+			{levelInfo, nil, "test %s\n", []interface{}{"test"}, "Jun 01 15:04:05: test test\n"},
+			{levelWarn, nil, "test\n", nil, "Jun 01 15:04:05: Warning: test\n"},
+			{levelError, nil, "test.", nil, "Jun 01 15:04:05: Error: test.\n"},
+			{levelInfo, requestLogFields(r), "connect\n", nil, "Jun 01 15:04:05: [0123456789abcdef] connect\n"},
+			{levelWarn, requestLogFields(r), "connect\n", nil, "Jun 01 15:04:05: [0123456789abcdef] Warning: connect\n"},
+		} {
+			buf := new(bytes.Buffer)
+			l := &logger{w: buf, level: levelInfo, now: now}
+			l.Log(c.Level, c.Fields, c.Format, c.Args...)
+			if buf.String() != c.Out {
+				t.Errorf("expected %#v, got %#v", c.Out, buf.String())
+			}
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		l := &logger{w: buf, now: now}
+		l.Configure(true, levelDebug)
+		l.Log(levelDebug, requestLogFields(r), "connect %s\n", "localhost:5900")
+		l.Log(levelError, nil, "test \"error\".\n")
+
+		exp := `{"time":"2020-06-01T15:04:05Z","level":"debug","msg":"connect localhost:5900","session":"0123456789abcdef","client":"127.0.0.1:1234","user":"user","target":"(default)"}` + "\n" +
+			`{"time":"2020-06-01T15:04:05Z","level":"error","msg":"test \"error\"."}` + "\n"
+		if buf.String() != exp {
+			t.Errorf("expected %#v, got %#v", exp, buf.String())
+		}
+
+		dec := json.NewDecoder(buf)
+		for dec.More() {
+			var v map[string]interface{}
+			if err := dec.Decode(&v); err != nil {
+				t.Errorf("invalid json: %v", err)
+			}
+		}
+	})
+
+	t.Run("Level", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		l := &logger{w: buf, now: now}
+		l.Configure(false, levelWarn)
+		l.Log(levelInfo, nil, "info\n")
+		l.Log(levelWarn, nil, "warn\n")
+		if exp := "Jun 01 15:04:05: Warning: warn\n"; buf.String() != exp {
+			t.Errorf("expected %#v, got %#v", exp, buf.String())
+		}
+	})
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, c := range []struct {
+		In  string
+		Out logLevel
+	}{
+		{"debug", levelDebug},
+		{"info", levelInfo},
+		{"WARN", levelWarn},
+		{"warning", levelWarn},
+		{"error", levelError},
+	} {
+		if l, err := parseLogLevel(c.In); err != nil {
+			t.Errorf("unexpected error parsing %#v: %v", c.In, err)
+		} else if l != c.Out {
+			t.Errorf("expected %#v to be %s, got %s", c.In, c.Out, l)
+		}
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+}
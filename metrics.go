@@ -0,0 +1,80 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Target labels for connections which aren't to a named target. These can't
+// conflict with target names since they contain parentheses.
+const (
+	targetLabelDefault   = "(default)"
+	targetLabelArbitrary = "(arbitrary)"
+	targetLabelRepeater  = "(repeater)"
+)
+
+// Reasons for rejecting a connection.
+const (
+	rejectArbitraryHosts = "arbitrary_hosts_disabled"
+	rejectArbitraryPorts = "arbitrary_ports_disabled"
+	rejectUnknownTarget  = "unknown_target"
+	rejectCIDR           = "cidr_denied"
+	rejectUnixSocket     = "unix_socket_denied"
+	rejectListenerAllow  = "listener_denied"
+	rejectShuttingDown   = "shutting_down"
+	rejectDial           = "dial_error"
+	rejectMagic          = "magic_check_failed"
+	rejectVersion        = "invalid_version"
+)
+
+var (
+	metricUpgrades = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "easy_novnc",
+		Name:      "websocket_upgrades_total",
+		Help:      "Number of websocket connections upgraded for proxying.",
+	}, []string{"target"})
+
+	metricRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "easy_novnc",
+		Name:      "connections_rejected_total",
+		Help:      "Number of connections rejected or failed before proxying.",
+	}, []string{"reason"})
+
+	metricActiveSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "easy_novnc",
+		Name:      "active_sessions",
+		Help:      "Number of sessions currently being proxied.",
+	}, []string{"target"})
+
+	metricSessionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "easy_novnc",
+		Name:      "session_duration_seconds",
+		Help:      "Duration of proxied sessions.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9), // 1s to ~18h
+	}, []string{"target"})
+
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "easy_novnc",
+		Name:      "transferred_bytes_total",
+		Help:      "Number of bytes proxied in each direction (to_server or to_client).",
+	}, []string{"target", "direction"})
+)
+
+// withTarget returns a shallow copy of the request with the target label for
+// metrics set.
+func withTarget(r *http.Request, label string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyTarget, label))
+}
+
+// requestTarget returns the target label for metrics for a request. Since the
+// number of named targets is limited, the cardinality is bounded.
+func requestTarget(r *http.Request) string {
+	label, _ := r.Context().Value(ctxKeyTarget).(string)
+	return label
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRejected(t *testing.T) {
+	for _, c := range []struct {
+		URL    string
+		Reason string
+	}{
+		{"http://example.com/vnc/example.com", rejectArbitraryHosts},
+		{"http://example.com/vnc/t/unknown", rejectUnknownTarget},
+	} {
+		before := testutil.ToFloat64(metricRejected.WithLabelValues(c.Reason))
+
+		m := mux.NewRouter()
+		m.Handle("/vnc/t/{name:[a-zA-Z0-9_.-]+}", targetHandler(nil, proxyPolicy{}, nil, false, nil))
+		m.Handle("/vnc/{host:[a-zA-Z0-9_.-]+}", vncHandler("localhost", 5900, false, false, proxyPolicy{}, nil, false, nil))
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.URL, nil))
+
+		if after := testutil.ToFloat64(metricRejected.WithLabelValues(c.Reason)); after != before+1 {
+			t.Errorf("%s: expected %s rejections to be incremented from %v, got %v", c.URL, c.Reason, before, after)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	o, _, err := parseOptions([]string{"--metrics"}, func(string) (string, bool) { return "", false })
+	if err != nil {
+		panic(err)
+	}
+	for _, c := range []struct {
+		Metrics     bool
+		MetricsAddr string
+		Served      bool
+	}{
+		{false, "", false},
+		{true, "", true},
+		{true, "localhost:9090", false},
+	} {
+		o.Metrics, o.MetricsAddr = c.Metrics, c.MetricsAddr
+
+		h, err := newHandler(o)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		buf, _ := ioutil.ReadAll(w.Result().Body)
+
+		if served := strings.Contains(string(buf), "go_goroutines"); served != c.Served {
+			t.Errorf("metrics=%t metrics-addr=%#v: expected metrics served to be %t", c.Metrics, c.MetricsAddr, c.Served)
+		}
+	}
+}
+
+func TestCopyChCount(t *testing.T) {
+	var total int
+	dst := new(bytes.Buffer)
+	done := make(chan error)
+	go copyCh(dst, strings.NewReader("hello world"), func(p []byte) { total += len(p) }, done)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != dst.Len() || total != 11 {
+		t.Errorf("expected 11 bytes to be counted, got %d", total)
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	r := httptest.NewRequest("GET", "/vnc", nil)
+	if l := requestTarget(r); l != "" {
+		t.Errorf("expected no target label, got %#v", l)
+	}
+	if l := requestTarget(withTarget(r, targetLabelDefault)); l != targetLabelDefault {
+		t.Errorf("expected target label %#v, got %#v", targetLabelDefault, l)
+	}
+}
@@ -0,0 +1,324 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/acme"
+)
+
+// options contains the parsed command line options.
+type options struct {
+	listenOptions
+
+	ArbitraryHosts      bool
+	ArbitraryPorts      bool
+	CIDRWhitelist       []string
+	CIDRBlacklist       []string
+	UnixSocketWhitelist []string
+	Host                string
+	Port                uint16
+	BasicUI             bool
+	Verbose             bool
+	LogFormat           string
+	LogLevel            string
+	NoURLPassword       bool
+	NoVNCParams         []string
+	DefaultViewOnly     bool
+	ForceViewOnly       bool
+	ViewOnlyUsers       []string
+	Htpasswd            string
+	TrustedProxyCIDR    []string
+	Targets             string
+	UserHeader          string
+	Metrics             bool
+	RecordDir           string
+	RecordRetention     time.Duration
+	Config              string
+	Help                bool
+
+	// sources describes the options which were set from the environment or
+	// config file, which is logged once the log format is known
+	sources []string
+}
+
+// listenOptions contains the options which can only be applied by restarting.
+type listenOptions struct {
+	Addr            []string
+	UnixSocketMode  string
+	UnixSocketOwner string
+	TLSCert         string
+	TLSKey          string
+	TLSSelfSigned   bool
+	ACMEDomain      []string
+	ACMEEmail       string
+	ACMEDirectory   string
+	ACMECache       string
+	ACMEHTTPAddr    string
+	AdminAddr       string
+	AdminHtpasswd   string
+	DrainTimeout    time.Duration
+	MetricsAddr     string
+	RepeaterAddr    string
+}
+
+// envmap maps option names to environment variables.
+var envmap = map[string]string{
+	"arbitrary-hosts":       "NOVNC_ARBITRARY_HOSTS",
+	"arbitrary-ports":       "NOVNC_ARBITRARY_PORTS",
+	"cidr-whitelist":        "NOVNC_CIDR_WHITELIST",
+	"cidr-blacklist":        "NOVNC_CIDR_BLACKLIST",
+	"unix-socket-whitelist": "NOVNC_UNIX_SOCKET_WHITELIST",
+	"host":                  "NOVNC_HOST",
+	"port":                  "NOVNC_PORT",
+	"addr":                  "NOVNC_ADDR",
+	"unix-socket-mode":      "NOVNC_UNIX_SOCKET_MODE",
+	"unix-socket-owner":     "NOVNC_UNIX_SOCKET_OWNER",
+	"basic-ui":              "NOVNC_BASIC_UI",
+	"no-url-password":       "NOVNC_NO_URL_PASSWORD",
+	"novnc-params":          "NOVNC_PARAMS",
+	"default-view-only":     "NOVNC_DEFAULT_VIEW_ONLY",
+	"force-view-only":       "NOVNC_FORCE_VIEW_ONLY",
+	"view-only-users":       "NOVNC_VIEW_ONLY_USERS",
+	"verbose":               "NOVNC_VERBOSE",
+	"log-format":            "NOVNC_LOG_FORMAT",
+	"log-level":             "NOVNC_LOG_LEVEL",
+	"tls-cert":              "NOVNC_TLS_CERT",
+	"tls-key":               "NOVNC_TLS_KEY",
+	"tls-self-signed":       "NOVNC_TLS_SELF_SIGNED",
+	"acme-domain":           "NOVNC_ACME_DOMAIN",
+	"acme-email":            "NOVNC_ACME_EMAIL",
+	"acme-directory":        "NOVNC_ACME_DIRECTORY",
+	"acme-cache":            "NOVNC_ACME_CACHE",
+	"acme-http-addr":        "NOVNC_ACME_HTTP_ADDR",
+	"htpasswd":              "NOVNC_HTPASSWD",
+	"trusted-proxy-cidr":    "NOVNC_TRUSTED_PROXY_CIDR",
+	"user-header":           "NOVNC_USER_HEADER",
+	"targets":               "NOVNC_TARGETS",
+	"config":                "NOVNC_CONFIG",
+	"admin-addr":            "NOVNC_ADMIN_ADDR",
+	"admin-htpasswd":        "NOVNC_ADMIN_HTPASSWD",
+	"drain-timeout":         "NOVNC_DRAIN_TIMEOUT",
+	"metrics":               "NOVNC_METRICS",
+	"metrics-addr":          "NOVNC_METRICS_ADDR",
+	"record-dir":            "NOVNC_RECORD_DIR",
+	"record-retention":      "NOVNC_RECORD_RETENTION",
+	"repeater-addr":         "NOVNC_REPEATER_ADDR",
+}
+
+// newFlagSet creates a FlagSet for the options.
+func newFlagSet(o *options) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s [options]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	fs.BoolVarP(&o.ArbitraryHosts, "arbitrary-hosts", "H", false, "Allow connection to other hosts")
+	fs.BoolVarP(&o.ArbitraryPorts, "arbitrary-ports", "P", false, "Allow connections to arbitrary ports (requires arbitrary-hosts)")
+	fs.StringSliceVarP(&o.CIDRWhitelist, "cidr-whitelist", "c", []string{}, "CIDR whitelist for when arbitrary hosts are enabled (comma separated) (conflicts with blacklist)")
+	fs.StringSliceVarP(&o.CIDRBlacklist, "cidr-blacklist", "C", []string{}, "CIDR blacklist for when arbitrary hosts are enabled (comma separated) (conflicts with whitelist)")
+	fs.StringSliceVar(&o.UnixSocketWhitelist, "unix-socket-whitelist", nil, "Allow connections to unix sockets matching these glob patterns (e.g. /run/vnc/*.sock) (comma separated) (unix sockets are not allowed otherwise)")
+	fs.StringVarP(&o.Host, "host", "h", "localhost", "The host/ip (or unix:/path) to connect to by default")
+	fs.Uint16VarP(&o.Port, "port", "p", 5900, "The port to connect to by default (ignored for unix sockets)")
+	fs.StringSliceVarP(&o.Addr, "addr", "a", []string{":8080"}, "The addresses to listen on (host:port, unix:/path, or systemd[:name] for a socket passed by systemd socket activation) (repeatable or comma separated) (optionally followed by ?tls-cert=...&tls-key=..., ?tls=off, and/or ?allow=cidr&allow=cidr for per-listener TLS and client IP whitelists)")
+	fs.StringVar(&o.UnixSocketMode, "unix-socket-mode", "", "The octal permissions for unix sockets created for addr (e.g. 0660)")
+	fs.StringVar(&o.UnixSocketOwner, "unix-socket-owner", "", "The owner for unix sockets created for addr (user, user:group, or :group)")
+	fs.BoolVarP(&o.BasicUI, "basic-ui", "u", false, "Hide connection options from the main screen")
+	fs.BoolVarP(&o.Verbose, "verbose", "v", false, "Show extra log info (same as log-level=debug)")
+	fs.StringVar(&o.LogFormat, "log-format", "text", "The log format (text or json)")
+	fs.StringVar(&o.LogLevel, "log-level", "info", "The minimum log level (debug, info, warn, or error)")
+	fs.BoolVar(&o.NoURLPassword, "no-url-password", false, "Do not allow password in URL params")
+	fs.StringSliceVar(&o.NoVNCParams, "novnc-params", nil, "Extra URL params for noVNC (advanced) (comma separated key-value pairs) (e.g. resize=remote)")
+	fs.BoolVar(&o.DefaultViewOnly, "default-view-only", false, "Use view-only by default")
+	fs.BoolVar(&o.ForceViewOnly, "force-view-only", false, "Enforce view-only on the server for all connections by dropping keyboard, mouse, and clipboard input")
+	fs.StringSliceVar(&o.ViewOnlyUsers, "view-only-users", nil, "Enforce view-only on the server for connections by these authenticated users (comma separated)")
+	fs.StringVar(&o.TLSCert, "tls-cert", "", "Serve HTTPS using this TLS certificate (reloaded when changed) (requires tls-key)")
+	fs.StringVar(&o.TLSKey, "tls-key", "", "Serve HTTPS using this TLS key (reloaded when changed) (requires tls-cert)")
+	fs.BoolVar(&o.TLSSelfSigned, "tls-self-signed", false, "Generate a self-signed certificate and store it in tls-cert and tls-key if they do not exist")
+	fs.StringSliceVar(&o.ACMEDomain, "acme-domain", nil, "Serve HTTPS using certificates automatically obtained from an ACME CA for these domains (comma separated) (conflicts with tls-cert)")
+	fs.StringVar(&o.ACMEEmail, "acme-email", "", "Contact email for the ACME account (optional)")
+	fs.StringVar(&o.ACMEDirectory, "acme-directory", acme.LetsEncryptURL, "ACME directory URL")
+	fs.StringVar(&o.ACMECache, "acme-cache", "", "Directory to store ACME accounts and certificates in (defaults to easy-novnc/acme in the user cache dir)")
+	fs.StringVar(&o.ACMEHTTPAddr, "acme-http-addr", "", "The address to listen on for ACME HTTP-01 challenges and HTTPS redirects (e.g. :80) (TLS-ALPN-01 on addr is always enabled)")
+	fs.StringVar(&o.Htpasswd, "htpasswd", "", "Require HTTP basic authentication using this htpasswd file (bcrypt or sha1)")
+	fs.StringSliceVar(&o.TrustedProxyCIDR, "trusted-proxy-cidr", nil, "CIDRs of authenticating reverse proxies to trust user-header from (comma separated)")
+	fs.StringVar(&o.Targets, "targets", "", "Load named targets from this YAML/JSON file (served at /vnc/t/{name} and shown in the main screen)")
+	fs.StringVar(&o.UserHeader, "user-header", "", "Require the authenticated user to be set in this header (e.g. X-Forwarded-User) by a trusted proxy (falls back to htpasswd if set) (requires trusted-proxy-cidr or a unix socket addr, which is always trusted)")
+	fs.StringVar(&o.Config, "config", "", "Load options from this YAML file (keys are the long option names) (command line options take precedence over environment variables, which take precedence over the config file) (reloaded on SIGHUP)")
+	fs.StringVar(&o.AdminAddr, "admin-addr", "", "The address to listen on for the admin API (e.g. localhost:8081) (requires admin-htpasswd) (disabled if not set)")
+	fs.StringVar(&o.AdminHtpasswd, "admin-htpasswd", "", "Require HTTP basic authentication for the admin API using this htpasswd file (bcrypt or sha1)")
+	fs.DurationVar(&o.DrainTimeout, "drain-timeout", time.Second*30, "On SIGTERM/SIGINT, stop accepting new connections and wait this long for active sessions to finish before closing them")
+	fs.BoolVar(&o.Metrics, "metrics", false, "Serve Prometheus metrics at /metrics")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address instead (e.g. localhost:9090) (implies metrics)")
+	fs.StringVar(&o.RecordDir, "record-dir", "", "Record the VNC traffic of each session to a file in this directory")
+	fs.DurationVar(&o.RecordRetention, "record-retention", 0, "Delete recordings older than this (e.g. 720h) (checked hourly) (kept forever if zero)")
+	fs.StringVar(&o.RepeaterAddr, "repeater-addr", "", "The address to listen on for VNC servers connecting in UltraVNC repeater mode II (e.g. :5500) (served at /vnc/repeater/{id}) (disabled if not set)")
+	fs.BoolVar(&o.Help, "help", false, "Show this help text")
+
+	fs.VisitAll(func(flag *pflag.Flag) {
+		if env, ok := envmap[flag.Name]; ok {
+			flag.Usage += fmt.Sprintf(" (env %s)", env)
+		}
+	})
+
+	return fs
+}
+
+// parseOptions parses options from the command line arguments, environment,
+// and config file (in order of decreasing precedence). If the returned error is
+// pflag.ErrHelp, the returned FlagSet can be used to show the usage.
+func parseOptions(args []string, lookupEnv func(string) (string, bool)) (*options, *pflag.FlagSet, error) {
+	o := new(options)
+	fs := newFlagSet(o)
+
+	// the command line is parsed first, and the environment is only applied to
+	// the flags which weren't set there, since setting a slice flag again
+	// appends to it rather than replacing it
+	if err := fs.Parse(args); err != nil {
+		return nil, fs, err
+	}
+
+	var err error
+	fromEnv := map[string]bool{}
+	fs.VisitAll(func(flag *pflag.Flag) {
+		if env, ok := envmap[flag.Name]; ok && err == nil && !flag.Changed {
+			if val, ok := lookupEnv(env); ok {
+				fromEnv[flag.Name] = true
+				o.sources = append(o.sources, fmt.Sprintf("Setting --%s from %s to %#v", flag.Name, env, val))
+				if err = flag.Value.Set(val); err != nil {
+					err = fmt.Errorf("invalid argument %#v for %s: %v", val, env, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, fs, err
+	}
+
+	if val, ok := lookupEnv("PORT"); ok && !fs.Changed("addr") && !fromEnv["addr"] {
+		val = ":" + val
+		fromEnv["addr"] = true
+		o.sources = append(o.sources, fmt.Sprintf("Setting --addr from PORT to %#v", val))
+		if err := fs.Lookup("addr").Value.Set(val); err != nil {
+			return nil, fs, err
+		}
+	}
+
+	if o.Help {
+		return nil, fs, pflag.ErrHelp
+	}
+
+	if o.Config != "" {
+		if err := loadConfig(fs, o.Config, func(flag *pflag.Flag) bool {
+			return flag.Changed || fromEnv[flag.Name]
+		}, func(flag *pflag.Flag, val string) {
+			o.sources = append(o.sources, fmt.Sprintf("Setting --%s from %s to %#v", flag.Name, o.Config, val))
+		}); err != nil {
+			return nil, fs, fmt.Errorf("error loading config: %w", err)
+		}
+	}
+
+	if err := o.validate(); err != nil {
+		return nil, fs, err
+	}
+
+	return o, fs, nil
+}
+
+// validate checks for conflicting and missing options.
+func (o *options) validate() error {
+	if o.ArbitraryPorts && !o.ArbitraryHosts {
+		return errors.New("arbitrary-ports requires arbitrary-hosts to be enabled")
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be specified together")
+	}
+	if o.TLSSelfSigned && o.TLSCert == "" {
+		return errors.New("tls-self-signed requires tls-cert and tls-key")
+	}
+	if len(o.ACMEDomain) != 0 && o.TLSCert != "" {
+		return errors.New("acme-domain conflicts with tls-cert")
+	}
+	if o.ACMEHTTPAddr != "" && len(o.ACMEDomain) == 0 {
+		return errors.New("acme-http-addr requires acme-domain")
+	}
+	if o.AdminAddr != "" && o.AdminHtpasswd == "" {
+		return errors.New("admin-addr requires admin-htpasswd")
+	}
+	if len(o.TrustedProxyCIDR) != 0 && o.UserHeader == "" {
+		return errors.New("trusted-proxy-cidr requires user-header")
+	}
+	if o.LogFormat != "text" && o.LogFormat != "json" {
+		return fmt.Errorf("unknown log format %#v (expected text or json)", o.LogFormat)
+	}
+	if _, err := parseLogLevel(o.LogLevel); err != nil {
+		return err
+	}
+	if len(o.Addr) == 0 {
+		return errors.New("at least one addr is required")
+	}
+	var unixAddr bool
+	for _, a := range o.Addr {
+		la, err := parseListenAddr(a)
+		if err != nil {
+			return fmt.Errorf("addr %#v: %w", a, err)
+		}
+		if _, ok := unixSocketPath(la.Addr); ok {
+			unixAddr = true
+		}
+	}
+	if o.UserHeader != "" && len(o.TrustedProxyCIDR) == 0 && !unixAddr {
+		return errors.New("user-header requires trusted-proxy-cidr or a unix socket addr")
+	}
+	if !unixAddr && (o.UnixSocketMode != "" || o.UnixSocketOwner != "") {
+		return errors.New("unix-socket-mode and unix-socket-owner require a unix socket addr")
+	}
+	if o.UnixSocketMode != "" {
+		if m, err := strconv.ParseUint(o.UnixSocketMode, 8, 32); err != nil || m > 0777 {
+			return fmt.Errorf("invalid unix-socket-mode %#v (expected octal permissions)", o.UnixSocketMode)
+		}
+	}
+	if path, ok := unixSocketPath(o.Host); ok {
+		if err := checkUnixSocketPath(path); err != nil {
+			return fmt.Errorf("host: %w", err)
+		}
+	}
+	for _, pattern := range o.UnixSocketWhitelist {
+		if !filepath.IsAbs(pattern) {
+			return fmt.Errorf("unix-socket-whitelist pattern %#v must be absolute", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("unix-socket-whitelist pattern %#v: %w", pattern, err)
+		}
+	}
+	if o.RecordRetention < 0 {
+		return errors.New("record-retention must not be negative")
+	}
+	return nil
+}
+
+// unixSocketMode returns the mode for unix sockets (which must have been
+// validated), or zero if it wasn't set.
+func (o *listenOptions) unixSocketMode() os.FileMode {
+	m, _ := strconv.ParseUint(o.UnixSocketMode, 8, 32)
+	return os.FileMode(m)
+}
+
+// logLevel returns the log level for the options (which must have been
+// validated).
+func (o *options) logLevel() logLevel {
+	if o.Verbose {
+		return levelDebug
+	}
+	level, _ := parseLogLevel(o.LogLevel)
+	return level
+}
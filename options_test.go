@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestParseOptions(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	cfg := filepath.Join(d, "config.yaml")
+	if err := ioutil.WriteFile(cfg, []byte("host: file\nport: 1\naddr: :1\ncidr-whitelist: [10.0.0.0/8]\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	env := func(m map[string]string) func(string) (string, bool) {
+		return func(k string) (string, bool) {
+			v, ok := m[k]
+			return v, ok
+		}
+	}
+
+	o, _, err := parseOptions([]string{"--config", cfg, "-h", "cli"}, env(map[string]string{
+		"NOVNC_HOST": "env",
+		"NOVNC_PORT": "2",
+		"PORT":       "3",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.Host != "cli" {
+		t.Errorf("expected host from command line, got %#v", o.Host)
+	}
+	if o.Port != 2 {
+		t.Errorf("expected port from env, got %d", o.Port)
+	}
+	if !reflect.DeepEqual(o.Addr, []string{":3"}) {
+		t.Errorf("expected addr from PORT, got %#v", o.Addr)
+	}
+	if !reflect.DeepEqual(o.CIDRWhitelist, []string{"10.0.0.0/8"}) {
+		t.Errorf("expected cidr whitelist from config, got %#v", o.CIDRWhitelist)
+	}
+	if o.ACMEDirectory == "" {
+		t.Errorf("expected default acme directory")
+	}
+	if exp := []string{
+		`Setting --port from NOVNC_PORT to "2"`,
+		`Setting --addr from PORT to ":3"`,
+		`Setting --cidr-whitelist from ` + cfg + ` to "10.0.0.0/8"`,
+	}; !reflect.DeepEqual(o.sources, exp) {
+		t.Errorf("expected sources %#v, got %#v", exp, o.sources)
+	}
+
+	// slice flags from the command line replace the env rather than adding to it
+	if o, _, err := parseOptions([]string{"--cidr-whitelist", "192.168.0.0/16"}, env(map[string]string{
+		"NOVNC_CIDR_WHITELIST": "10.0.0.0/8",
+	})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if !reflect.DeepEqual(o.CIDRWhitelist, []string{"192.168.0.0/16"}) {
+		t.Errorf("expected cidr whitelist from command line only, got %#v", o.CIDRWhitelist)
+	}
+
+	// PORT only applies if addr isn't set elsewhere
+	for _, c := range []struct {
+		Args []string
+		Env  map[string]string
+		Addr []string
+	}{
+		{nil, map[string]string{"PORT": "8080"}, []string{":8080"}},
+		{[]string{"--addr", ":9000"}, map[string]string{"PORT": "8080"}, []string{":9000"}},
+		{[]string{"--addr", ":9000", "--addr", "unix:/run/easy-novnc.sock"}, map[string]string{"PORT": "8080"}, []string{":9000", "unix:/run/easy-novnc.sock"}},
+		{nil, map[string]string{"PORT": "8080", "NOVNC_ADDR": ":9000"}, []string{":9000"}},
+		{[]string{"--addr", ":9001"}, map[string]string{"PORT": "8080", "NOVNC_ADDR": ":9000"}, []string{":9001"}},
+	} {
+		if o, _, err := parseOptions(c.Args, env(c.Env)); err != nil {
+			t.Errorf("%v %v: unexpected error: %v", c.Args, c.Env, err)
+		} else if !reflect.DeepEqual(o.Addr, c.Addr) {
+			t.Errorf("%v %v: expected addr %#v, got %#v", c.Args, c.Env, c.Addr, o.Addr)
+		}
+	}
+
+	// requests on unix sockets are trusted to set the user header
+	if _, _, err := parseOptions([]string{"--addr", "unix:/run/easy-novnc.sock", "--user-header", "X-Forwarded-User"}, env(nil)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if o, _, err := parseOptions([]string{"--log-level", "error", "--verbose"}, env(nil)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if l := o.logLevel(); l != levelDebug {
+		t.Errorf("expected verbose to override log level, got %s", l)
+	}
+
+	if _, _, err := parseOptions([]string{"--help"}, env(nil)); err != pflag.ErrHelp {
+		t.Errorf("expected ErrHelp, got %v", err)
+	}
+
+	for _, c := range [][]string{
+		{"--arbitrary-ports"},
+		{"--tls-cert", "cert.pem"},
+		{"--tls-self-signed"},
+		{"--acme-domain", "example.com", "--tls-cert", "cert.pem", "--tls-key", "key.pem"},
+		{"--acme-http-addr", ":80"},
+		{"--admin-addr", "localhost:8081"},
+		{"--user-header", "X-Forwarded-User"},
+		{"--trusted-proxy-cidr", "10.0.0.0/8"},
+		{"--config", filepath.Join(d, "nonexistent.yaml")},
+		{"--log-format", "xml"},
+		{"--log-level", "trace"},
+		{"--host", "unix:run/vnc.sock"},
+		{"--addr", "unix:easy-novnc.sock"},
+		{"--addr", ""},
+		{"--addr", ":8080", "--addr", ":8443?tls-cert=cert.pem"},
+		{"--addr", ":8443?tls=off&tls-cert=cert.pem&tls-key=key.pem"},
+		{"--addr", ":8080?allow=10.0.0.0"},
+		{"--addr", "unix:/run/easy-novnc.sock?allow=10.0.0.0/8"},
+		{"--addr", ":8080?unknown=1"},
+		{"--unix-socket-mode", "0660"},
+		{"--addr", "unix:/run/easy-novnc.sock", "--unix-socket-mode", "0999"},
+		{"--addr", "unix:/run/easy-novnc.sock", "--unix-socket-mode", "01777"},
+		{"--host", "unix:/run/vnc/../vnc.sock"},
+		{"--unix-socket-whitelist", "run/vnc/*.sock"},
+		{"--unix-socket-whitelist", "/run/vnc/[.sock"},
+		{"--nonexistent"},
+	} {
+		if _, _, err := parseOptions(c, env(nil)); err == nil {
+			t.Errorf("expected error for %#v", c)
+		}
+	}
+
+	if _, _, err := parseOptions(nil, env(map[string]string{"NOVNC_PORT": "invalid"})); err == nil {
+		t.Errorf("expected error for invalid env")
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	o, _, err := parseOptions(nil, func(string) (string, bool) { return "", false })
+	if err != nil {
+		panic(err)
+	}
+	if _, err := newHandler(o); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, c := range []func(o *options){
+		func(o *options) { o.CIDRWhitelist = []string{"invalid"} },
+		func(o *options) { o.CIDRWhitelist, o.CIDRBlacklist = []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"} },
+		func(o *options) { o.TrustedProxyCIDR = []string{"invalid"} },
+		func(o *options) { o.NoVNCParams = []string{"resize"} },
+		func(o *options) { o.NoVNCParams = []string{"password=test"} },
+		func(o *options) { o.Targets = "nonexistent.yaml" },
+		func(o *options) { o.Htpasswd = "nonexistent" },
+	} {
+		no := *o
+		c(&no)
+		if _, err := newHandler(&no); err == nil {
+			t.Errorf("expected error for %+v", no)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recordings are stored as:
+//
+//	magic    [8]byte  "ENVNCREC"
+//	hdrlen   uint32   length of the header
+//	header   []byte   JSON-encoded recordingHeader
+//	frames...
+//
+// where each frame is:
+//
+//	offset   int64    nanoseconds since the start of the session
+//	dir      uint8    recToServer or recToClient
+//	length   uint32   length of the data
+//	data     []byte
+//
+// All integers are big-endian. Each frame contains the data from a single
+// write, and a recording may end at any point if the proxy was stopped.
+const recordingMagic = "ENVNCREC"
+
+// recordingExt is the extension for recording files.
+const recordingExt = ".rec"
+
+// Frame directions.
+const (
+	recToServer uint8 = 0
+	recToClient uint8 = 1
+)
+
+// recordingBuffer is the number of frames which can be queued for writing
+// before the recording is abandoned.
+const recordingBuffer = 4096
+
+// recordingMaxFrame is the maximum length of a frame. Larger writes are split
+// into multiple frames, so the whole frame can be read into memory.
+const recordingMaxFrame = 1 << 20
+
+// recordingHeader contains information about a recorded session.
+type recordingHeader struct {
+	ID     string    `json:"id"`
+	Client string    `json:"client"`
+	User   string    `json:"user,omitempty"`
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+}
+
+// recordingFrame is a single frame of a recording.
+type recordingFrame struct {
+	Offset time.Duration
+	Dir    uint8
+	Data   []byte
+}
+
+// recordings manages session recordings.
+var recordings = new(recordingStore)
+
+// recordingStore manages the recording directory.
+type recordingStore struct {
+	mu        sync.Mutex
+	dir       string
+	retention time.Duration
+}
+
+// Configure sets the directory to store recordings in (or disables recording
+// if empty), and how long to keep them for (or forever if zero). The directory
+// is created if it doesn't exist.
+func (rs *recordingStore) Configure(dir string, retention time.Duration) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("create recording dir: %w", err)
+		}
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.dir, rs.retention = dir, retention
+	return nil
+}
+
+// Start starts recording a session. If recording is disabled, nil is returned.
+func (rs *recordingStore) Start(s *session) (*recorder, error) {
+	rs.mu.Lock()
+	dir := rs.dir
+	rs.mu.Unlock()
+
+	if dir == "" {
+		return nil, nil
+	}
+
+	fn := filepath.Join(dir, s.Start.UTC().Format("20060102T150405Z")+"-"+s.ID+recordingExt)
+	return newRecorder(fn, recordingHeader{
+		ID:     s.ID,
+		Client: s.Client,
+		User:   s.User,
+		Target: s.Target,
+		Start:  s.Start,
+	})
+}
+
+// Find returns the filename of the recording for a session ID.
+func (rs *recordingStore) Find(id string) (string, error) {
+	rs.mu.Lock()
+	dir := rs.dir
+	rs.mu.Unlock()
+
+	if dir == "" {
+		return "", errors.New("recording is disabled")
+	}
+	if id == "" || strings.ContainsAny(id, `/\*?[`) {
+		return "", os.ErrNotExist
+	}
+
+	m, err := filepath.Glob(filepath.Join(dir, "*-"+id+recordingExt))
+	if err != nil {
+		return "", err
+	}
+	if len(m) == 0 {
+		return "", os.ErrNotExist
+	}
+	return m[0], nil
+}
+
+// Prune deletes recordings older than the retention period, and returns the
+// number of deleted files.
+func (rs *recordingStore) Prune() (int, error) {
+	rs.mu.Lock()
+	dir, retention := rs.dir, rs.retention
+	rs.mu.Unlock()
+
+	if dir == "" || retention <= 0 {
+		return 0, nil
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, fi := range fis {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != recordingExt || time.Since(fi.ModTime()) < retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// recorder writes a recording in the background. Writes never block; if the
+// disk can't keep up or a write fails, the recording is abandoned.
+type recorder struct {
+	failed int32 // atomic
+
+	fn       string
+	f        *os.File
+	bw       *bufio.Writer
+	start    time.Time
+	ch       chan recordingFrame
+	finished chan struct{}
+	once     sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// newRecorder creates a recording file and writes the header.
+func newRecorder(fn string, hdr recordingHeader) (*recorder, error) {
+	buf, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		fn:       fn,
+		f:        f,
+		bw:       bufio.NewWriter(f),
+		start:    hdr.Start,
+		ch:       make(chan recordingFrame, recordingBuffer),
+		finished: make(chan struct{}),
+	}
+
+	r.bw.WriteString(recordingMagic)
+	binary.Write(r.bw, binary.BigEndian, uint32(len(buf)))
+	r.bw.Write(buf)
+	if err := r.bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// Filename returns the filename of the recording.
+func (r *recorder) Filename() string {
+	return r.fn
+}
+
+// Record queues data to be written, split into frames of at most
+// recordingMaxFrame. The data is copied. It must not be called after Close.
+func (r *recorder) Record(dir uint8, p []byte) {
+	offset := time.Since(r.start)
+	for len(p) != 0 {
+		if atomic.LoadInt32(&r.failed) != 0 {
+			return
+		}
+		n := len(p)
+		if n > recordingMaxFrame {
+			n = recordingMaxFrame
+		}
+		frame := recordingFrame{
+			Offset: offset,
+			Dir:    dir,
+			Data:   append([]byte(nil), p[:n]...),
+		}
+		select {
+		case r.ch <- frame:
+		default:
+			r.fail(errors.New("recording is too slow, abandoning it"))
+		}
+		p = p[n:]
+	}
+}
+
+// fail marks the recording as failed. The first error is returned by Close.
+func (r *recorder) fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+	atomic.StoreInt32(&r.failed, 1)
+}
+
+// Close finishes writing the recording. If the recording was abandoned, the
+// error which caused it is returned.
+func (r *recorder) Close() error {
+	r.once.Do(func() {
+		close(r.ch)
+	})
+	<-r.finished
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *recorder) run() {
+	var hdr [13]byte
+	for frame := range r.ch {
+		if atomic.LoadInt32(&r.failed) != 0 {
+			continue // drain
+		}
+		binary.BigEndian.PutUint64(hdr[0:], uint64(frame.Offset))
+		hdr[8] = frame.Dir
+		binary.BigEndian.PutUint32(hdr[9:], uint32(len(frame.Data)))
+		r.bw.Write(hdr[:])
+		r.bw.Write(frame.Data)
+		if len(r.ch) == 0 {
+			if err := r.bw.Flush(); err != nil {
+				r.fail(err)
+			}
+		}
+	}
+	if err := r.bw.Flush(); err != nil {
+		r.fail(err)
+	}
+	if err := r.f.Close(); err != nil {
+		r.fail(err)
+	}
+	close(r.finished)
+}
+
+// recordingReader reads a recording.
+type recordingReader struct {
+	Header recordingHeader
+
+	r   *bufio.Reader
+	hdr [13]byte
+}
+
+// newRecordingReader reads the header of a recording.
+func newRecordingReader(r io.Reader) (*recordingReader, error) {
+	rr := &recordingReader{r: bufio.NewReader(r)}
+
+	var magic [len(recordingMagic)]byte
+	if _, err := io.ReadFull(rr.r, magic[:]); err != nil {
+		return nil, fmt.Errorf("read magic: %w", err)
+	}
+	if string(magic[:]) != recordingMagic {
+		return nil, errors.New("not a recording")
+	}
+
+	var n uint32
+	if err := binary.Read(rr.r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("read header length: %w", err)
+	}
+	if n > 1<<20 {
+		return nil, fmt.Errorf("header too long (%d bytes)", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if err := json.Unmarshal(buf, &rr.Header); err != nil {
+		return nil, fmt.Errorf("parse header: %w", err)
+	}
+
+	return rr, nil
+}
+
+// Next reads the next frame. At the end of the recording, io.EOF is returned.
+// If the recording ends in the middle of a frame, io.ErrUnexpectedEOF is
+// returned.
+func (rr *recordingReader) Next() (recordingFrame, error) {
+	if _, err := io.ReadFull(rr.r, rr.hdr[:]); err != nil {
+		return recordingFrame{}, err
+	}
+
+	n := binary.BigEndian.Uint32(rr.hdr[9:])
+	if n > recordingMaxFrame {
+		return recordingFrame{}, fmt.Errorf("frame too long (%d bytes)", n)
+	}
+
+	frame := recordingFrame{
+		Offset: time.Duration(binary.BigEndian.Uint64(rr.hdr[0:])),
+		Dir:    rr.hdr[8],
+		Data:   make([]byte, n),
+	}
+	if _, err := io.ReadFull(rr.r, frame.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return recordingFrame{}, err
+	}
+	return frame, nil
+}
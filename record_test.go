@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecording(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	rs := new(recordingStore)
+
+	s := &session{ID: "0123456789abcdef", Client: "127.0.0.1:1234", User: "user", Target: "localhost:5900", Start: time.Now()}
+	if rec, err := rs.Start(s); err != nil || rec != nil {
+		t.Fatalf("expected no recording when disabled, got %v, %v", rec, err)
+	}
+
+	if err := rs.Configure(filepath.Join(d, "recordings"), time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rec, err := rs.Start(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec.Record(recToClient, []byte("RFB 003.008\n"))
+	rec.Record(recToServer, []byte("RFB 003.008\n"))
+	rec.Record(recToClient, []byte{1, 1})
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fn, err := rs.Find(s.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if fn != rec.Filename() {
+		t.Errorf("expected to find %s, got %s", rec.Filename(), fn)
+	}
+	for _, id := range []string{"", "*", "../0123456789abcdef", "fedcba9876543210"} {
+		if _, err := rs.Find(id); !os.IsNotExist(err) {
+			t.Errorf("expected not exist error for %#v, got %v", id, err)
+		}
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	rr, err := newRecordingReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rr.Header.ID != s.ID || rr.Header.Client != s.Client || rr.Header.User != s.User || rr.Header.Target != s.Target || !rr.Header.Start.Equal(s.Start) {
+		t.Errorf("incorrect header %+v", rr.Header)
+	}
+
+	var last time.Duration
+	for i, exp := range []struct {
+		Dir  uint8
+		Data string
+	}{
+		{recToClient, "RFB 003.008\n"},
+		{recToServer, "RFB 003.008\n"},
+		{recToClient, "\x01\x01"},
+	} {
+		frame, err := rr.Next()
+		if err != nil {
+			t.Fatalf("frame %d: unexpected error: %v", i, err)
+		}
+		if frame.Dir != exp.Dir || string(frame.Data) != exp.Data {
+			t.Errorf("frame %d: expected %d %q, got %d %q", i, exp.Dir, exp.Data, frame.Dir, frame.Data)
+		}
+		if frame.Offset < last {
+			t.Errorf("frame %d: offset went backwards", i)
+		}
+		last = frame.Offset
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := newRecordingReader(bytes.NewReader([]byte("not a recording"))); err == nil {
+		t.Errorf("expected error for invalid recording")
+	}
+
+	if buf, err := ioutil.ReadFile(fn); err != nil {
+		panic(err)
+	} else if rr, err := newRecordingReader(bytes.NewReader(append(buf, 0, 0, 0, 0, 0, 0, 0, 0, recToClient, 0xff, 0xff, 0xff, 0xff))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else {
+		for i := 0; i < 3; i++ {
+			rr.Next()
+		}
+		if _, err := rr.Next(); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("expected error for oversized frame, got %v", err)
+		}
+	}
+
+	if n, err := rs.Prune(); err != nil || n != 0 {
+		t.Errorf("expected new recording not to be pruned, got %d, %v", n, err)
+	}
+	old := time.Now().Add(-time.Hour * 2)
+	if err := os.Chtimes(fn, old, old); err != nil {
+		panic(err)
+	}
+	if n, err := rs.Prune(); err != nil || n != 1 {
+		t.Errorf("expected old recording to be pruned, got %d, %v", n, err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("expected recording to be deleted")
+	}
+}
+
+func TestRecorderNonBlocking(t *testing.T) {
+	// a recorder which isn't being written
+	r := &recorder{
+		start:    time.Now(),
+		ch:       make(chan recordingFrame, 1),
+		finished: make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			r.Record(recToClient, []byte("test"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("record blocked")
+	}
+	if r.err == nil {
+		t.Errorf("expected recording to be abandoned")
+	}
+}
+
+func TestRecorderSplit(t *testing.T) {
+	r := &recorder{
+		start: time.Now(),
+		ch:    make(chan recordingFrame, 4),
+	}
+
+	data := bytes.Repeat([]byte{1}, recordingMaxFrame*2+1)
+	r.Record(recToClient, data)
+	close(r.ch)
+
+	var buf []byte
+	for frame := range r.ch {
+		if len(frame.Data) > recordingMaxFrame {
+			t.Errorf("expected frame to be at most %d bytes, got %d", recordingMaxFrame, len(frame.Data))
+		}
+		buf = append(buf, frame.Data...)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("expected frames to contain the data")
+	}
+}
@@ -0,0 +1,244 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repeaterIDSize is the size of the ID message sent by servers connecting to
+// an UltraVNC repeater in mode II ("ID:" followed by the ID, padded with
+// zeros).
+const repeaterIDSize = 250
+
+// repeaterHandshakeTimeout is how long servers connecting to the repeater have
+// to send their ID.
+const repeaterHandshakeTimeout = time.Second * 30
+
+// repeaterMaxPending is the maximum number of servers which can be connected
+// to the repeater without having been paired with a viewer, including ones
+// which haven't sent their ID yet.
+var repeaterMaxPending = 100
+
+// repeaterIDRegexp matches valid repeater IDs.
+var repeaterIDRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// repeaters contains the servers waiting on the repeater.
+var repeaters = newRepeaterRegistry()
+
+// repeaterRegistry keeps track of the servers which connected to the repeater
+// and are waiting for a viewer, by ID.
+type repeaterRegistry struct {
+	mu      sync.Mutex
+	waiting map[string]*repeaterServer
+	pending int // servers which haven't sent their ID yet
+}
+
+// repeaterServer is a server waiting on the repeater.
+type repeaterServer struct {
+	id    string
+	conn  net.Conn
+	br    *bufio.Reader
+	since time.Time
+	taken bool          // protected by the registry mutex
+	idle  chan struct{} // closed when the server isn't being read from
+}
+
+func newRepeaterRegistry() *repeaterRegistry {
+	return &repeaterRegistry{waiting: map[string]*repeaterServer{}}
+}
+
+// parseRepeaterID parses the ID message sent by a server.
+func parseRepeaterID(buf []byte) (string, error) {
+	msg := string(bytes.TrimRight(buf, "\x00"))
+	if !strings.HasPrefix(msg, "ID:") {
+		if len(msg) > 16 {
+			msg = msg[:16] + "..."
+		}
+		return "", fmt.Errorf("expected ID:xxxx, got %q", msg)
+	}
+	id := strings.TrimPrefix(msg, "ID:")
+	if !repeaterIDRegexp.MatchString(id) {
+		return "", fmt.Errorf("invalid ID %q (must only contain numbers)", id)
+	}
+	return id, nil
+}
+
+// Serve accepts connections from servers on l until it is closed.
+func (rr *repeaterRegistry) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		rr.mu.Lock()
+		full := rr.pending+len(rr.waiting) >= repeaterMaxPending
+		if !full {
+			rr.pending++
+		}
+		rr.mu.Unlock()
+
+		if full {
+			logf(levelWarn, "rejected repeater connection from %s: too many servers waiting\n", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		go rr.handle(c)
+	}
+}
+
+// repeaterSameHost returns true if two remote addresses have the same host.
+func repeaterSameHost(a, b net.Addr) bool {
+	ha, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		ha = a.String()
+	}
+	hb, _, err := net.SplitHostPort(b.String())
+	if err != nil {
+		hb = b.String()
+	}
+	return ha == hb
+}
+
+// handle reads the ID from a server and adds it to the registry. If another
+// server is already waiting with the same ID, it is only replaced if the new
+// one is from the same host (it is probably a stale connection from the same
+// server), otherwise the new one is rejected.
+func (rr *repeaterRegistry) handle(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(repeaterHandshakeTimeout))
+	buf := make([]byte, repeaterIDSize)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		logf(levelDebug, "error reading repeater ID from %s: %v\n", c.RemoteAddr(), err)
+		rr.abandon(c)
+		return
+	}
+	id, err := parseRepeaterID(buf)
+	if err != nil {
+		logf(levelWarn, "rejected repeater connection from %s: %v\n", c.RemoteAddr(), err)
+		rr.abandon(c)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	s := &repeaterServer{
+		id:    id,
+		conn:  c,
+		br:    bufio.NewReader(c),
+		since: time.Now(),
+		idle:  make(chan struct{}),
+	}
+
+	rr.mu.Lock()
+	rr.pending--
+	old := rr.waiting[id]
+	conflict := old != nil && !repeaterSameHost(old.conn.RemoteAddr(), c.RemoteAddr())
+	if !conflict {
+		rr.waiting[id] = s
+	}
+	rr.mu.Unlock()
+
+	if conflict {
+		logf(levelWarn, "rejected repeater server %s with ID %s: %s is already waiting with it\n", c.RemoteAddr(), id, old.conn.RemoteAddr())
+		c.Close()
+		return
+	}
+	if old != nil {
+		logf(levelWarn, "repeater server %s replaced %s waiting with ID %s\n", c.RemoteAddr(), old.conn.RemoteAddr(), id)
+		old.conn.Close()
+	}
+	logf(levelInfo, "repeater server %s waiting with ID %s\n", c.RemoteAddr(), id)
+
+	go rr.monitor(s)
+}
+
+// abandon closes a server connection which didn't send a valid ID.
+func (rr *repeaterRegistry) abandon(c net.Conn) {
+	rr.mu.Lock()
+	rr.pending--
+	rr.mu.Unlock()
+	c.Close()
+}
+
+// monitor removes a waiting server from the registry if it disconnects, or if
+// it sends more than fits in the buffer before being paired. Since servers send
+// their version right after the ID, it keeps buffering what is sent until the
+// connection fails or the server is taken.
+func (rr *repeaterRegistry) monitor(s *repeaterServer) {
+	defer close(s.idle)
+
+	var err error
+	for err == nil {
+		if s.br.Buffered() == s.br.Size() {
+			err = errors.New("sent too much data before being paired")
+			break
+		}
+		_, err = s.br.Peek(s.br.Buffered() + 1)
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if s.taken {
+		return
+	}
+	if rr.waiting[s.id] == s {
+		delete(rr.waiting, s.id)
+		logf(levelInfo, "repeater server %s with ID %s disconnected after %s: %v\n", s.conn.RemoteAddr(), s.id, time.Since(s.since).Round(time.Second), err)
+	}
+	s.conn.Close()
+}
+
+// Take removes the server waiting with id from the registry and returns the
+// connection to it.
+func (rr *repeaterRegistry) Take(id string) (net.Conn, bool) {
+	rr.mu.Lock()
+	s, ok := rr.waiting[id]
+	if ok {
+		delete(rr.waiting, id)
+		s.taken = true
+	}
+	rr.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	// interrupt the monitor so the connection can be read from
+	s.conn.SetReadDeadline(time.Unix(1, 0))
+	<-s.idle
+	s.conn.SetReadDeadline(time.Time{})
+
+	return &bufferedConn{s.conn, s.br}, true
+}
+
+// Len returns the number of servers waiting.
+func (rr *repeaterRegistry) Len() int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return len(rr.waiting)
+}
+
+// dialer returns a dialFunc which pairs the request with the server waiting
+// with id. If there isn't one, the error is a *rfbFailure.
+func (rr *repeaterRegistry) dialer(id string) dialFunc {
+	return func(r *http.Request) (net.Conn, error) {
+		conn, ok := rr.Take(id)
+		if !ok {
+			return nil, &rfbFailure{fmt.Sprintf("no server waiting with repeater ID %s", id), fmt.Sprintf("No server is waiting with ID %s.", id)}
+		}
+		logr(r, levelInfo, "paired %s with repeater server %s (ID %s)\n", requestWho(r), conn.RemoteAddr(), id)
+		return conn, nil
+	}
+}
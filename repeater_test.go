@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+func TestParseRepeaterID(t *testing.T) {
+	id := func(s string) []byte {
+		buf := make([]byte, repeaterIDSize)
+		copy(buf, s)
+		return buf
+	}
+	if v, err := parseRepeaterID(id("ID:1234")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if v != "1234" {
+		t.Errorf("expected ID 1234, got %q", v)
+	}
+	for _, c := range []string{"", "ID:", "ID:abc", "ID:12 34", "RFB 003.008\n", "1234"} {
+		if _, err := parseRepeaterID(id(c)); err == nil {
+			t.Errorf("%q: expected error", c)
+		}
+	}
+}
+
+func TestRepeater(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	rr := newRepeaterRegistry()
+	go rr.Serve(l)
+
+	connect := func(id string) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		buf := make([]byte, repeaterIDSize)
+		copy(buf, id)
+		c.Write(buf)
+		return c
+	}
+	waitLen := func(what string, n int) {
+		t.Helper()
+		for i := 0; rr.Len() != n; i++ {
+			if i == 100 {
+				t.Fatalf("%s: expected %d waiting servers, got %d", what, n, rr.Len())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// invalid handshakes are closed
+	c := connect("RFB 003.008\n")
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected invalid handshake to be closed, got %v", err)
+	}
+	c.Close()
+
+	// servers are removed when they disconnect
+	c = connect("ID:5678")
+	waitLen("connected", 1)
+	c.Close()
+	waitLen("disconnected", 0)
+
+	// including after sending their version
+	c = connect("ID:5678")
+	c.Write([]byte("RFB 003.008\n"))
+	waitLen("connected with version", 1)
+	time.Sleep(time.Millisecond * 50)
+	c.Close()
+	waitLen("disconnected after version", 0)
+
+	// a new server with the same ID replaces the old one
+	old := connect("ID:1234")
+	defer old.Close()
+	waitLen("old", 1)
+	s := connect("ID:1234")
+	defer s.Close()
+	old.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := old.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected old server to be closed, got %v", err)
+	}
+	waitLen("replaced", 1)
+
+	if _, ok := rr.Take("5678"); ok {
+		t.Errorf("expected no server waiting with ID 5678")
+	}
+
+	// the server can send the version before a viewer is connected
+	s.Write([]byte("RFB 003.008\n"))
+	time.Sleep(time.Millisecond * 50)
+
+	v, ok := rr.Take("1234")
+	if !ok {
+		t.Fatalf("expected server waiting with ID 1234")
+	}
+	defer v.Close()
+	waitLen("taken", 0)
+
+	v.SetDeadline(time.Now().Add(time.Second * 5))
+	expectRead(t, "version", v, []byte("RFB 003.008\n"))
+	v.Write([]byte("RFB 003.008\n"))
+	s.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectRead(t, "client version", s, []byte("RFB 003.008\n"))
+}
+
+func TestRepeaterHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	rr := newRepeaterRegistry()
+	go rr.Serve(l)
+
+	m := mux.NewRouter()
+	m.Handle("/vnc/repeater/{id:[0-9]+}", repeaterHandler(rr, proxyPolicy{}))
+	hs := httptest.NewServer(m)
+	defer hs.Close()
+
+	dial := func(id string) (*websocket.Conn, *bufio.Reader) {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/vnc/repeater/"+id, "binary", hs.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ws, bufio.NewReader(ws)
+	}
+
+	// no server waiting
+	ws, br := dial("1234")
+	expectRead(t, "version", br, []byte("RFB 003.008\n"))
+	ws.Write([]byte("RFB 003.008\n"))
+	expectRead(t, "failure", br, join([]byte{0}, []byte{0, 0, 0, 34}, "No server is waiting with ID 1234."))
+	ws.Close()
+
+	s, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, repeaterIDSize)
+	copy(buf, "ID:1234")
+	s.Write(buf)
+	for i := 0; rr.Len() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("expected server to be waiting")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- rfbServerHandshake(bufio.NewReader(s), s, testServerInit)
+	}()
+
+	ws, br = dial("1234")
+	defer ws.Close()
+	expectRead(t, "version", br, []byte("RFB 003.008\n"))
+	ws.Write([]byte("RFB 003.008\n"))
+	expectRead(t, "security types", br, []byte{1, rfbSecNone})
+	ws.Write([]byte{rfbSecNone})
+	expectRead(t, "security result", br, []byte{0, 0, 0, 0})
+	ws.Write([]byte{1})
+	expectRead(t, "server init", br, testServerInit)
+	if err := <-done; err != nil {
+		t.Errorf("unexpected server handshake error: %v", err)
+	}
+}
+
+// repeaterTestConn overrides the remote address of a connection.
+type repeaterTestConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c repeaterTestConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRepeaterLimits(t *testing.T) {
+	defer func(n int) {
+		repeaterMaxPending = n
+	}(repeaterMaxPending)
+	repeaterMaxPending = 2
+
+	rr := newRepeaterRegistry()
+	waitPending := func(what string, pending, waiting int) {
+		t.Helper()
+		for i := 0; ; i++ {
+			rr.mu.Lock()
+			p, w := rr.pending, len(rr.waiting)
+			rr.mu.Unlock()
+			if p == pending && w == waiting {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("%s: expected %d pending and %d waiting servers, got %d and %d", what, pending, waiting, p, w)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	closed := func(what string, c net.Conn) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: expected connection to be closed, got %v", what, err)
+		}
+	}
+
+	// a server with the same ID only replaces the waiting one if it's from
+	// the same host
+	connect := func(ip, id string) net.Conn {
+		c, s := net.Pipe()
+		rr.mu.Lock()
+		rr.pending++
+		rr.mu.Unlock()
+		go rr.handle(repeaterTestConn{s, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+		buf := make([]byte, repeaterIDSize)
+		copy(buf, id)
+		c.Write(buf)
+		return c
+	}
+
+	a := connect("10.0.0.1", "ID:1234")
+	defer a.Close()
+	waitPending("first", 0, 1)
+
+	b := connect("10.0.0.2", "ID:1234")
+	defer b.Close()
+	closed("other host", b)
+	waitPending("other host", 0, 1)
+
+	c := connect("10.0.0.1", "ID:1234")
+	defer c.Close()
+	closed("replaced", a)
+	waitPending("same host", 0, 1)
+
+	v, ok := rr.Take("1234")
+	if !ok {
+		t.Fatalf("expected server waiting with ID 1234")
+	}
+	if h := v.RemoteAddr().(*net.TCPAddr).IP.String(); h != "10.0.0.1" {
+		t.Errorf("expected server from 10.0.0.1 to be waiting, got %s", h)
+	}
+	v.Close()
+	waitPending("taken", 0, 0)
+
+	// servers which haven't sent their ID yet count towards the limit
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	go rr.Serve(l)
+
+	dial := func(id string) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != "" {
+			buf := make([]byte, repeaterIDSize)
+			copy(buf, id)
+			c.Write(buf)
+		}
+		return c
+	}
+
+	w := dial("ID:1")
+	defer w.Close()
+	waitPending("waiting", 0, 1)
+	p := dial("")
+	waitPending("pending", 1, 1)
+	x := dial("")
+	defer x.Close()
+	closed("over limit", x)
+
+	p.Close()
+	waitPending("abandoned", 0, 1)
+	y := dial("ID:2")
+	defer y.Close()
+	waitPending("under limit", 0, 2)
+}
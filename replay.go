@@ -0,0 +1,491 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// Replay keyboard controls (X11 keysyms).
+const (
+	replayKeyPause  = 0x0020 // space
+	replayKeySeek   = 0xff53 // right
+	replayKeyFaster = 0xff52 // up
+	replayKeySlower = 0xff54 // down
+	replayKeyNormal = 0x0031 // 1
+)
+
+// replaySeekStep is how far the seek key skips ahead.
+const replaySeekStep = time.Second * 10
+
+// replayHandler creates a handler which replays recordings as a fake VNC server
+// over a websocket, with the recording ID taken from the url vars. Requests
+// which aren't websocket upgrades are redirected to the noVNC player.
+func replayHandler() http.Handler {
+	ws := websocket.Server{
+		Handshake: wsProxyHandshake,
+		Handler:   replayWSHandler,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		fn, err := recordings.Find(id)
+		if os.IsNotExist(err) {
+			http.Error(w, "recording not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error finding recording: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		opts, err := parseReplayOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Header.Get("Upgrade") == "" {
+			path := "replay/" + id
+			if r.URL.RawQuery != "" {
+				path += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, "/vnc.html?"+url.Values{
+				"autoconnect": {"true"},
+				"resize":      {"scale"},
+				"path":        {path},
+			}.Encode(), http.StatusFound)
+			return
+		}
+
+		logr(r, levelInfo, "replaying %s for %s (speed: %g, start: %s)\n", fn, requestWho(r), opts.Speed, opts.Start)
+		ws.ServeHTTP(w, withReplay(r, fn, opts))
+	})
+}
+
+// replayOptions contains the initial playback options.
+type replayOptions struct {
+	Speed  float64
+	Start  time.Duration
+	Paused bool
+}
+
+// parseReplayOptions parses the speed, t (start offset, as a duration or
+// seconds), and paused query params.
+func parseReplayOptions(q url.Values) (replayOptions, error) {
+	opts := replayOptions{Speed: 1}
+	if v := q.Get("speed"); v != "" {
+		s, err := strconv.ParseFloat(v, 64)
+		if err != nil || s <= 0 || s > 64 {
+			return opts, fmt.Errorf("invalid speed %#v (must be > 0 and <= 64)", v)
+		}
+		opts.Speed = s
+	}
+	if v := q.Get("t"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			s, err1 := strconv.ParseFloat(v, 64)
+			if err1 != nil {
+				return opts, fmt.Errorf("invalid start time %#v", v)
+			}
+			d = time.Duration(s * float64(time.Second))
+		}
+		if d < 0 {
+			return opts, fmt.Errorf("invalid start time %#v", v)
+		}
+		opts.Start = d
+	}
+	if v := q.Get("paused"); v != "" {
+		p, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid paused value %#v", v)
+		}
+		opts.Paused = p
+	}
+	return opts, nil
+}
+
+type replayCtx struct {
+	fn   string
+	opts replayOptions
+}
+
+// withReplay returns a shallow copy of the request with the recording to replay
+// set.
+func withReplay(r *http.Request, fn string, opts replayOptions) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyReplay, replayCtx{fn, opts}))
+}
+
+// replayWSHandler is a websocket.Handler which replays the recording set by
+// withReplay.
+func replayWSHandler(ws *websocket.Conn) {
+	defer ws.Close()
+	r := ws.Request()
+	rc := r.Context().Value(ctxKeyReplay).(replayCtx)
+
+	ws.PayloadType = websocket.BinaryFrame
+
+	f, err := os.Open(rc.fn)
+	if err != nil {
+		logr(r, levelError, "error opening recording: %v.\n", err)
+		return
+	}
+	defer f.Close()
+
+	rr, err := newRecordingReader(f)
+	if err != nil {
+		logr(r, levelError, "error reading recording %s: %v.\n", rc.fn, err)
+		return
+	}
+
+	rs := newReplayStream(rr)
+	sc, cs := rs.Reader(recToClient), rs.Reader(recToServer)
+
+	serverInit, err := skipRecordedHandshake(sc, cs)
+	if err != nil {
+		logr(r, levelError, "error reading handshake from recording %s: %v.\n", rc.fn, err)
+		return
+	}
+	rs.Discard(recToServer)
+
+	// the name of the desktop is shown in the title
+	name := "[replay] " + string(serverInit[24:])
+	serverInit = append(serverInit[:20:20], make([]byte, 4)...)
+	binary.BigEndian.PutUint32(serverInit[20:], uint32(len(name)))
+	serverInit = append(serverInit, name...)
+
+	br := bufio.NewReader(ws)
+	if err := rfbServerHandshake(br, ws, serverInit); err != nil {
+		logr(r, levelDebug, "replay handshake for %s: %v\n", requestWho(r), err)
+		return
+	}
+
+	first := sc.Remaining()
+	ctl := newReplayControl(rc.opts, first.Offset)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			m, err := readRFBClientMessage(br)
+			if err != nil {
+				return
+			}
+			if down, keysym, ok := m.KeyEvent(); ok && down {
+				ctl.Key(keysym)
+			}
+		}
+	}()
+
+	frame, ok := first, len(first.Data) != 0
+	for {
+		if !ok {
+			if frame, err = rs.Next(recToClient); err == io.EOF || err == io.ErrUnexpectedEOF {
+				logr(r, levelDebug, "finished replaying %s for %s\n", rc.fn, requestWho(r))
+				break
+			} else if err != nil {
+				logr(r, levelError, "error reading recording %s: %v.\n", rc.fn, err)
+				return
+			}
+		}
+		ok = false
+
+		if !ctl.Wait(frame.Offset, done) {
+			return
+		}
+		if _, err := ws.Write(frame.Data); err != nil {
+			return
+		}
+	}
+
+	// keep the last frame on the screen until the client disconnects
+	<-done
+}
+
+// skipRecordedHandshake reads the handshake from the server-to-client and
+// client-to-server streams of a recording, and returns the ServerInit message.
+func skipRecordedHandshake(sc, cs io.Reader) ([]byte, error) {
+	err := func() error {
+		buf := make([]byte, 16)
+
+		if _, err := io.ReadFull(sc, buf[:12]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(cs, buf[:12]); err != nil {
+			return err
+		}
+		v, err := parseRFBVersion(buf[:12])
+		if err != nil {
+			return err
+		}
+
+		var sec uint8
+		if v.Negotiated() == 3 {
+			if _, err := io.ReadFull(sc, buf[:4]); err != nil {
+				return err
+			}
+			if t := binary.BigEndian.Uint32(buf); t > 255 {
+				return fmt.Errorf("invalid security type %d", t)
+			} else {
+				sec = uint8(t)
+			}
+		} else {
+			if _, err := io.ReadFull(sc, buf[:1]); err != nil {
+				return err
+			} else if buf[0] == 0 {
+				sec = rfbSecInvalid
+			} else if _, err := io.ReadFull(sc, make([]byte, buf[0])); err != nil {
+				return err
+			} else if _, err := io.ReadFull(cs, buf[:1]); err != nil {
+				return err
+			} else {
+				sec = buf[0]
+			}
+		}
+
+		switch sec {
+		case rfbSecInvalid:
+			return errors.New("server refused the connection")
+		case rfbSecNone:
+		case rfbSecVNCAuth:
+			if _, err := io.ReadFull(sc, buf[:16]); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(cs, buf[:16]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported security type %d", sec)
+		}
+
+		if v.Negotiated() == 8 || sec == rfbSecVNCAuth {
+			if _, err := io.ReadFull(sc, buf[:4]); err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint32(buf) != 0 {
+				return errors.New("authentication failed")
+			}
+		}
+
+		if _, err := io.ReadFull(cs, buf[:1]); err != nil { // ClientInit
+			return err
+		}
+		return nil
+	}()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serverInit := make([]byte, 24)
+	if _, err := io.ReadFull(sc, serverInit); err != nil {
+		return nil, fmt.Errorf("read ServerInit: %w", err)
+	}
+	n := binary.BigEndian.Uint32(serverInit[20:])
+	if n > 1<<16 {
+		return nil, errors.New("read ServerInit: name too long")
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(sc, name); err != nil {
+		return nil, fmt.Errorf("read ServerInit: %w", err)
+	}
+	return append(serverInit, name...), nil
+}
+
+// replayStream demultiplexes the directions of a recording.
+type replayStream struct {
+	rr      *recordingReader
+	queue   [2][]recordingFrame
+	discard [2]bool
+}
+
+func newReplayStream(rr *recordingReader) *replayStream {
+	return &replayStream{rr: rr}
+}
+
+// Next returns the next frame in the specified direction. Frames in the other
+// direction are queued unless discarded.
+func (s *replayStream) Next(dir uint8) (recordingFrame, error) {
+	if len(s.queue[dir]) != 0 {
+		frame := s.queue[dir][0]
+		s.queue[dir] = s.queue[dir][1:]
+		return frame, nil
+	}
+	for {
+		frame, err := s.rr.Next()
+		if err != nil {
+			return frame, err
+		}
+		if frame.Dir > recToClient {
+			return frame, fmt.Errorf("invalid frame direction %d", frame.Dir)
+		}
+		if frame.Dir == dir {
+			return frame, nil
+		}
+		if !s.discard[frame.Dir] {
+			s.queue[frame.Dir] = append(s.queue[frame.Dir], frame)
+		}
+	}
+}
+
+// Discard stops queueing frames in the specified direction.
+func (s *replayStream) Discard(dir uint8) {
+	s.discard[dir] = true
+	s.queue[dir] = nil
+}
+
+// Reader returns an io.Reader for the data in the specified direction.
+func (s *replayStream) Reader(dir uint8) *replayReader {
+	return &replayReader{s: s, dir: dir}
+}
+
+// replayReader reads the data in one direction of a replayStream.
+type replayReader struct {
+	s   *replayStream
+	dir uint8
+	cur recordingFrame
+}
+
+func (r *replayReader) Read(buf []byte) (int, error) {
+	for len(r.cur.Data) == 0 {
+		frame, err := r.s.Next(r.dir)
+		if err != nil {
+			return 0, err
+		}
+		r.cur = frame
+	}
+	n := copy(buf, r.cur.Data)
+	r.cur.Data = r.cur.Data[n:]
+	return n, nil
+}
+
+// Remaining returns the unread data from the current frame.
+func (r *replayReader) Remaining() recordingFrame {
+	return r.cur
+}
+
+// replayControl controls the timing of a replay.
+type replayControl struct {
+	mu      sync.Mutex
+	pos     time.Duration // the current position in the recording
+	seek    time.Duration // frames before this are sent immediately
+	speed   float64
+	paused  bool
+	changed chan struct{}
+}
+
+// newReplayControl creates a replayControl starting at the specified offset in
+// the recording.
+func newReplayControl(opts replayOptions, start time.Duration) *replayControl {
+	return &replayControl{
+		pos:     start,
+		seek:    start + opts.Start,
+		speed:   opts.Speed,
+		paused:  opts.Paused,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Key handles a key press.
+func (c *replayControl) Key(keysym uint32) {
+	c.mu.Lock()
+	switch keysym {
+	case replayKeyPause:
+		c.paused = !c.paused
+	case replayKeySeek:
+		if c.seek < c.pos {
+			c.seek = c.pos
+		}
+		c.seek += replaySeekStep
+	case replayKeyFaster:
+		if c.speed < 64 {
+			c.speed *= 2
+		}
+	case replayKeySlower:
+		if c.speed > 1.0/8 {
+			c.speed /= 2
+		}
+	case replayKeyNormal:
+		c.speed = 1
+	default:
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Wait waits until the specified offset in the recording should be played. It
+// returns false if done is closed first.
+func (c *replayControl) Wait(offset time.Duration, done <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if offset <= c.seek {
+			if offset > c.pos {
+				c.pos = offset
+			}
+			c.mu.Unlock()
+			return true
+		}
+		if c.pos < c.seek {
+			c.pos = c.seek
+		}
+		if offset <= c.pos {
+			c.mu.Unlock()
+			return true
+		}
+		paused, speed := c.paused, c.speed
+		wait := time.Duration(float64(offset-c.pos) / speed)
+		c.mu.Unlock()
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if !paused {
+			t = time.NewTimer(wait)
+			timeout = t.C
+		}
+
+		start := time.Now()
+		select {
+		case <-timeout:
+			c.mu.Lock()
+			c.pos = offset
+			c.mu.Unlock()
+			return true
+		case <-c.changed:
+			if !paused {
+				c.mu.Lock()
+				c.pos += time.Duration(float64(time.Since(start)) * speed)
+				c.mu.Unlock()
+			}
+		case <-done:
+			if t != nil {
+				t.Stop()
+			}
+			return false
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// testServerInit is a ServerInit message for a 4x3 desktop named "test".
+var testServerInit = append([]byte{0, 4, 0, 3, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0, 0, 0, 0, 4}, "test"...)
+
+func TestParseReplayOptions(t *testing.T) {
+	for _, c := range []struct {
+		Query string
+		Opts  replayOptions
+		Error bool
+	}{
+		{"", replayOptions{Speed: 1}, false},
+		{"speed=2.5&t=1m30s&paused=1", replayOptions{Speed: 2.5, Start: time.Second * 90, Paused: true}, false},
+		{"t=1.5", replayOptions{Speed: 1, Start: time.Millisecond * 1500}, false},
+		{"speed=0", replayOptions{}, true},
+		{"speed=100", replayOptions{}, true},
+		{"t=-1s", replayOptions{}, true},
+		{"t=abc", replayOptions{}, true},
+		{"paused=maybe", replayOptions{}, true},
+	} {
+		q, _ := url.ParseQuery(c.Query)
+		opts, err := parseReplayOptions(q)
+		if c.Error {
+			if err == nil {
+				t.Errorf("%#v: expected error", c.Query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", c.Query, err)
+		} else if opts != c.Opts {
+			t.Errorf("%#v: expected %+v, got %+v", c.Query, c.Opts, opts)
+		}
+	}
+}
+
+func TestSkipRecordedHandshake(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		SC, CS []byte
+		Error  bool
+	}{
+		{"3.8None", join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit, "rest"), join("RFB 003.008\n", []byte{1}, []byte{1}), false},
+		{"3.8VNCAuth", join("RFB 003.008\n", []byte{2, 1, 2}, make([]byte, 16), []byte{0, 0, 0, 0}, testServerInit, "rest"), join("RFB 003.008\n", []byte{2}, make([]byte, 16), []byte{1}), false},
+		{"3.7None", join("RFB 003.008\n", []byte{1, 1}, testServerInit, "rest"), join("RFB 003.007\n", []byte{1}, []byte{1}), false},
+		{"3.3None", join("RFB 003.003\n", []byte{0, 0, 0, 1}, testServerInit, "rest"), join("RFB 003.003\n", []byte{1}), false},
+		{"3.3VNCAuth", join("RFB 003.003\n", []byte{0, 0, 0, 2}, make([]byte, 16), []byte{0, 0, 0, 0}, testServerInit, "rest"), join("RFB 003.003\n", make([]byte, 16), []byte{1}), false},
+		{"AuthFailed", join("RFB 003.008\n", []byte{1, 2}, make([]byte, 16), []byte{0, 0, 0, 1}), join("RFB 003.008\n", []byte{2}, make([]byte, 16)), true},
+		{"Refused", join("RFB 003.008\n", []byte{0}), join("RFB 003.008\n"), true},
+		{"Unsupported", join("RFB 003.008\n", []byte{1, 16}), join("RFB 003.008\n", []byte{16}), true},
+		{"Truncated", join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit[:10]), join("RFB 003.008\n", []byte{1}, []byte{1}), true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			sc, cs := bytes.NewReader(c.SC), bytes.NewReader(c.CS)
+			si, err := skipRecordedHandshake(sc, cs)
+			if c.Error {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(si, testServerInit) {
+				t.Errorf("expected ServerInit %v, got %v", testServerInit, si)
+			}
+			if rest, _ := ioutil.ReadAll(sc); string(rest) != "rest" {
+				t.Errorf("expected the rest of the stream to be left, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	if err := recordings.Configure(d, 0); err != nil {
+		panic(err)
+	}
+	defer recordings.Configure("", 0)
+
+	start := time.Now()
+	rec, err := newRecorder(d+"/20200601T150405Z-0123456789abcdef.rec", recordingHeader{ID: "0123456789abcdef", Start: start})
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range []struct {
+		Offset time.Duration
+		Dir    uint8
+		Data   []byte
+	}{
+		{0, recToClient, []byte("RFB 003.008\n")},
+		{0, recToServer, []byte("RFB 003.008\n")},
+		{0, recToClient, []byte{1, 1}},
+		{0, recToServer, []byte{1}},
+		{0, recToClient, []byte{0, 0, 0, 0}},
+		{0, recToServer, []byte{1}},
+		{time.Second, recToClient, join(testServerInit, "frame1")},
+		{time.Second * 2, recToServer, []byte("ignored")},
+		{time.Second * 10, recToClient, []byte("frame2")},
+		{time.Second * 11, recToClient, []byte("frame3")},
+	} {
+		rec.start = start.Add(-f.Offset) // fake the timestamps
+		rec.Record(f.Dir, f.Data)
+	}
+	if err := rec.Close(); err != nil {
+		panic(err)
+	}
+
+	m := mux.NewRouter()
+	m.Handle("/replay/{id:[a-zA-Z0-9_-]+}", replayHandler())
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	t.Run("Redirect", func(t *testing.T) {
+		c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := c.Get(s.URL + "/replay/0123456789abcdef?speed=2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Errorf("expected redirect, got %d", resp.StatusCode)
+		} else if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "/vnc.html?") || !strings.Contains(loc, "path=replay%2F0123456789abcdef%3Fspeed%3D2") {
+			t.Errorf("incorrect redirect %#v", loc)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		resp, err := http.Get(s.URL + "/replay/fedcba9876543210")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Play", func(t *testing.T) {
+		// starting 9s in at 10x speed, frame1 is skipped to, then frame2 should
+		// come after ~0.1s and frame3 after another ~0.1s
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/replay/0123456789abcdef?t=8s&speed=10", "binary", s.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer ws.Close()
+
+		br := bufio.NewReader(ws)
+		expect := func(what string, exp []byte) {
+			buf := make([]byte, len(exp))
+			if _, err := io.ReadFull(br, buf); err != nil {
+				t.Fatalf("%s: unexpected error: %v", what, err)
+			}
+			if !bytes.Equal(buf, exp) {
+				t.Fatalf("%s: expected %q, got %q", what, exp, buf)
+			}
+		}
+
+		expect("version", []byte("RFB 003.008\n"))
+		ws.Write([]byte("RFB 003.008\n"))
+		expect("security types", []byte{1, rfbSecNone})
+		ws.Write([]byte{rfbSecNone})
+		expect("security result", []byte{0, 0, 0, 0})
+		ws.Write([]byte{1})
+
+		name := "[replay] test"
+		si := append([]byte(nil), testServerInit[:20]...)
+		si = append(si, 0, 0, 0, byte(len(name)))
+		expect("server init", append(si, name...))
+
+		n := time.Now()
+		expect("frame1", []byte("frame1"))
+		if d := time.Since(n); d > time.Millisecond*50 {
+			t.Errorf("expected frame1 to be sent immediately, took %s", d)
+		}
+		expect("frame2", []byte("frame2"))
+		if d := time.Since(n); d < time.Millisecond*50 || d > time.Millisecond*500 {
+			t.Errorf("expected frame2 to be sent after ~100ms, took %s", d)
+		}
+
+		// pause
+		ws.Write([]byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x20})
+		time.Sleep(time.Millisecond * 300)
+		ws.Write([]byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x20})
+		n = time.Now()
+		expect("frame3", []byte("frame3"))
+		if d := time.Since(n); d > time.Millisecond*200 {
+			t.Errorf("expected frame3 to be sent ~100ms after resuming, took %s", d)
+		}
+		if d := time.Since(n); d < time.Millisecond*20 {
+			t.Errorf("expected frame3 not to be sent while paused")
+		}
+	})
+}
+
+func TestReplayControl(t *testing.T) {
+	done := make(chan struct{})
+
+	c := newReplayControl(replayOptions{Speed: 1, Paused: true}, time.Second)
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		c.Key(replayKeySeek)
+	}()
+	n := time.Now()
+	if !c.Wait(time.Second*5, done) {
+		t.Fatalf("expected wait to succeed")
+	}
+	if d := time.Since(n); d > time.Millisecond*200 {
+		t.Errorf("expected seek to skip the wait, took %s", d)
+	}
+
+	c.Key(replayKeyFaster)
+	c.Key(replayKeyFaster)
+	if c.speed != 4 {
+		t.Errorf("expected speed 4, got %g", c.speed)
+	}
+	c.Key(replayKeySlower)
+	if c.speed != 2 {
+		t.Errorf("expected speed 2, got %g", c.speed)
+	}
+	c.Key(replayKeyNormal)
+	if c.speed != 1 {
+		t.Errorf("expected speed 1, got %g", c.speed)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		close(done)
+	}()
+	if c.Wait(time.Hour, done) {
+		t.Errorf("expected wait to be cancelled")
+	}
+}
+
+// join joins strings and byte slices.
+func join(parts ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		switch p := p.(type) {
+		case string:
+			buf.WriteString(p)
+		case []byte:
+			buf.Write(p)
+		default:
+			panic("unsupported type")
+		}
+	}
+	return buf.Bytes()
+}
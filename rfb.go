@@ -0,0 +1,1497 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync"
+)
+
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst
+
+// RFB security types.
+const (
+	rfbSecInvalid uint8 = 0
+	rfbSecNone    uint8 = 1
+	rfbSecVNCAuth uint8 = 2
+)
+
+// RFB client-to-server message types.
+const (
+	rfbSetPixelFormat          uint8 = 0
+	rfbSetEncodings            uint8 = 2
+	rfbFramebufferUpdateReq    uint8 = 3
+	rfbKeyEvent                uint8 = 4
+	rfbPointerEvent            uint8 = 5
+	rfbClientCutText           uint8 = 6
+	rfbEnableContinuousUpdates uint8 = 150
+	rfbClientFence             uint8 = 248
+	rfbXVP                     uint8 = 250
+	rfbSetDesktopSize          uint8 = 251
+	rfbQEMU                    uint8 = 255
+)
+
+// rfbMaxCutText is the maximum length of clipboard text which will be accepted.
+const rfbMaxCutText = 16 << 20
+
+// rfbCutTextLength parses the signed length of a ClientCutText or
+// ServerCutText message, which is negative for the extended clipboard.
+func rfbCutTextLength(buf []byte) (int, error) {
+	l := int64(int32(binary.BigEndian.Uint32(buf)))
+	if l < 0 {
+		l = -l // extended clipboard
+	}
+	if l > rfbMaxCutText {
+		return 0, fmt.Errorf("clipboard text too long (%d bytes)", l)
+	}
+	return int(l), nil
+}
+
+// rfbVersion is a RFB protocol version.
+type rfbVersion struct {
+	Major, Minor int
+}
+
+// parseRFBVersion parses a RFB ProtocolVersion message.
+func parseRFBVersion(buf []byte) (rfbVersion, error) {
+	var v rfbVersion
+	if len(buf) != 12 {
+		return v, errors.New("invalid protocol version length")
+	}
+	if _, err := fmt.Sscanf(string(buf), "RFB %03d.%03d\n", &v.Major, &v.Minor); err != nil {
+		return v, fmt.Errorf("invalid protocol version %q", buf)
+	}
+	return v, nil
+}
+
+// Negotiated returns the version which will be used for the handshake. Unknown
+// minor versions are treated as 3.3 as required by the spec, except for ones
+// newer than 3.8 (e.g. Apple's 3.889), which are treated as 3.8.
+func (v rfbVersion) Negotiated() int {
+	switch {
+	case v.Major != 3:
+		return 3
+	case v.Minor >= 8:
+		return 8
+	case v.Minor == 7:
+		return 7
+	default:
+		return 3
+	}
+}
+
+func (v rfbVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// rfbClientMessage is a message sent from the client to the server after the
+// handshake.
+type rfbClientMessage []byte
+
+// Type returns the message type.
+func (m rfbClientMessage) Type() uint8 {
+	return m[0]
+}
+
+// KeyEvent returns the key state and keysym if the message is a KeyEvent or a
+// QEMU ExtendedKeyEvent.
+func (m rfbClientMessage) KeyEvent() (down bool, keysym uint32, ok bool) {
+	switch {
+	case m[0] == rfbKeyEvent:
+		return m[1] != 0, binary.BigEndian.Uint32(m[4:8]), true
+	case m[0] == rfbQEMU && m[1] == 0:
+		return binary.BigEndian.Uint16(m[2:4]) != 0, binary.BigEndian.Uint32(m[4:8]), true
+	default:
+		return false, 0, false
+	}
+}
+
+// readRFBClientMessage reads a single client-to-server message.
+func readRFBClientMessage(r *bufio.Reader) (rfbClientMessage, error) {
+	t, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch t[0] {
+	case rfbSetPixelFormat:
+		n = 20
+	case rfbSetEncodings:
+		hdr, err := peekFull(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		n = 4 + 4*int(binary.BigEndian.Uint16(hdr[2:]))
+	case rfbFramebufferUpdateReq:
+		n = 10
+	case rfbKeyEvent:
+		n = 8
+	case rfbPointerEvent:
+		n = 6
+	case rfbClientCutText:
+		hdr, err := peekFull(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		l, err := rfbCutTextLength(hdr[4:])
+		if err != nil {
+			return nil, err
+		}
+		n = 8 + l
+	case rfbEnableContinuousUpdates:
+		n = 10
+	case rfbClientFence:
+		hdr, err := peekFull(r, 9)
+		if err != nil {
+			return nil, err
+		}
+		n = 9 + int(hdr[8])
+	case rfbXVP:
+		n = 4
+	case rfbSetDesktopSize:
+		hdr, err := peekFull(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		n = 8 + 16*int(hdr[6])
+	case rfbQEMU:
+		hdr, err := peekFull(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		switch hdr[1] {
+		case 0: // ExtendedKeyEvent
+			n = 12
+		default:
+			return nil, fmt.Errorf("unsupported qemu client message subtype %d", hdr[1])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported client message type %d", t[0])
+	}
+
+	m := make(rfbClientMessage, n)
+	if _, err := io.ReadFull(r, m); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// peekFull is like bufio.Reader.Peek, but returns io.ErrUnexpectedEOF if less
+// than n bytes are available.
+func peekFull(r *bufio.Reader, n int) ([]byte, error) {
+	buf, err := r.Peek(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+// RFB server-to-client message types.
+const (
+	rfbFramebufferUpdate      uint8 = 0
+	rfbSetColourMapEntries    uint8 = 1
+	rfbBell                   uint8 = 2
+	rfbServerCutText          uint8 = 3
+	rfbEndOfContinuousUpdates uint8 = 150
+	rfbServerFence            uint8 = 248
+	rfbServerXVP              uint8 = 250
+)
+
+// RFB encodings and pseudo-encodings.
+const (
+	rfbEncRaw                  int32 = 0
+	rfbEncCopyRect             int32 = 1
+	rfbEncRRE                  int32 = 2
+	rfbEncCoRRE                int32 = 4
+	rfbEncHextile              int32 = 5
+	rfbEncZlib                 int32 = 6
+	rfbEncTight                int32 = 7
+	rfbEncZRLE                 int32 = 16
+	rfbEncDesktopSize          int32 = -223
+	rfbEncLastRect             int32 = -224
+	rfbEncCursor               int32 = -239
+	rfbEncXCursor              int32 = -240
+	rfbEncQEMUExtendedKeyEvent int32 = -258
+	rfbEncDesktopName          int32 = -307
+	rfbEncExtendedDesktopSize  int32 = -308
+	rfbEncXVP                  int32 = -309
+	rfbEncFence                int32 = -312
+	rfbEncContinuousUpdates    int32 = -313
+	rfbEncExtendedClipboard    int32 = -1063131698 // 0xc0a1e5ce
+)
+
+// rfbMaxFramebufferPixels is the size of the largest framebuffer (8K) which
+// server messages are allowed to be large enough to update all at once.
+const rfbMaxFramebufferPixels = 7680 * 4320
+
+// rfbParsableEncoding returns true if server messages using the encoding can
+// be parsed by readRFBServerMessage.
+func rfbParsableEncoding(enc int32) bool {
+	switch enc {
+	case rfbEncRaw, rfbEncCopyRect, rfbEncRRE, rfbEncCoRRE, rfbEncHextile, rfbEncZlib, rfbEncTight, rfbEncZRLE,
+		rfbEncDesktopSize, rfbEncLastRect, rfbEncCursor, rfbEncXCursor, rfbEncQEMUExtendedKeyEvent,
+		rfbEncDesktopName, rfbEncExtendedDesktopSize, rfbEncXVP, rfbEncFence, rfbEncContinuousUpdates:
+		return true
+	}
+	// compression and quality levels (only used by the client)
+	return (enc >= -256 && enc <= -247) || (enc >= -32 && enc <= -23)
+}
+
+// rfbPixelFormat is a RFB PIXEL_FORMAT.
+type rfbPixelFormat [16]byte
+
+// BytesPerPixel returns the size of a pixel.
+func (pf rfbPixelFormat) BytesPerPixel() int {
+	return int(pf[0]) / 8
+}
+
+// TightBytesPerPixel returns the size of a pixel for the Tight encoding, which
+// only sends the color bytes for 24-bit true color.
+func (pf rfbPixelFormat) TightBytesPerPixel() int {
+	if pf[0] == 32 && pf[1] == 24 && pf[3] != 0 && binary.BigEndian.Uint16(pf[4:]) == 255 && binary.BigEndian.Uint16(pf[6:]) == 255 && binary.BigEndian.Uint16(pf[8:]) == 255 {
+		return 3
+	}
+	return pf.BytesPerPixel()
+}
+
+// PixelFormat returns the pixel format if the message is a SetPixelFormat.
+func (m rfbClientMessage) PixelFormat() (pf rfbPixelFormat, ok bool) {
+	if m[0] != rfbSetPixelFormat {
+		return pf, false
+	}
+	copy(pf[:], m[4:])
+	return pf, true
+}
+
+// Encodings returns the encodings if the message is a SetEncodings.
+func (m rfbClientMessage) Encodings() ([]int32, bool) {
+	if m[0] != rfbSetEncodings {
+		return nil, false
+	}
+	encs := make([]int32, (len(m)-4)/4)
+	for i := range encs {
+		encs[i] = int32(binary.BigEndian.Uint32(m[4+i*4:]))
+	}
+	return encs, true
+}
+
+// newRFBSetEncodings creates a SetEncodings message.
+func newRFBSetEncodings(encs []int32) rfbClientMessage {
+	m := make(rfbClientMessage, 4+len(encs)*4)
+	m[0] = rfbSetEncodings
+	binary.BigEndian.PutUint16(m[2:], uint16(len(encs)))
+	for i, enc := range encs {
+		binary.BigEndian.PutUint32(m[4+i*4:], uint32(enc))
+	}
+	return m
+}
+
+// CutText returns the text if the message is a ClientCutText. If extended is
+// true, the text is actually the extended clipboard data.
+func (m rfbClientMessage) CutText() (text []byte, extended bool, ok bool) {
+	if m[0] != rfbClientCutText {
+		return nil, false, false
+	}
+	return m[8:], int32(binary.BigEndian.Uint32(m[4:])) < 0, true
+}
+
+// rfbServerMessage is a message sent from the server to the client after the
+// handshake.
+type rfbServerMessage []byte
+
+// Type returns the message type.
+func (m rfbServerMessage) Type() uint8 {
+	return m[0]
+}
+
+// CutText returns the text if the message is a ServerCutText. If extended is
+// true, the text is actually the extended clipboard data.
+func (m rfbServerMessage) CutText() (text []byte, extended bool, ok bool) {
+	if m[0] != rfbServerCutText {
+		return nil, false, false
+	}
+	return m[8:], int32(binary.BigEndian.Uint32(m[4:])) < 0, true
+}
+
+// rfbFramebuffer is the pixel format and size of the framebuffer, which are
+// needed to parse server messages.
+type rfbFramebuffer struct {
+	PixelFormat   rfbPixelFormat
+	Width, Height int
+}
+
+// MaxServerMessage returns the maximum size of a server message which will be
+// accepted. This is enough to update the whole framebuffer (up to
+// rfbMaxFramebufferPixels) with raw pixels, plus a quarter for overhead like
+// rectangle headers, the cursor, and overlapping rectangles, or to send the
+// longest allowed clipboard text.
+func (fb rfbFramebuffer) MaxServerMessage() int {
+	px := fb.Width * fb.Height
+	if px > rfbMaxFramebufferPixels {
+		px = rfbMaxFramebufferPixels
+	}
+	n := px * fb.PixelFormat.BytesPerPixel() * 5 / 4
+	if n < rfbMaxCutText {
+		n = rfbMaxCutText
+	}
+	return n + 1<<16
+}
+
+// readRFBServerMessage reads a single server-to-client message, using fb to
+// parse framebuffer updates and limit the size of the message. If the message
+// resizes the framebuffer, fb is updated. Only the encodings accepted by
+// rfbParsableEncoding are supported.
+func readRFBServerMessage(r *bufio.Reader, fb *rfbFramebuffer) (rfbServerMessage, error) {
+	t, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &rfbMessageReader{r: r, max: fb.MaxServerMessage()}
+	switch t[0] {
+	case rfbFramebufferUpdate:
+		hdr := m.read(4)
+		for i, n := 0, int(binary.BigEndian.Uint16(hdr[2:])); i < n && m.err == nil; i++ {
+			rect := m.read(12)
+			w, h := int(binary.BigEndian.Uint16(rect[4:])), int(binary.BigEndian.Uint16(rect[6:]))
+			enc := int32(binary.BigEndian.Uint32(rect[8:]))
+			if enc == rfbEncLastRect {
+				break
+			}
+			// for ExtendedDesktopSize, a non-zero y-position is an error
+			// status, and the size is unchanged
+			if enc == rfbEncDesktopSize || (enc == rfbEncExtendedDesktopSize && binary.BigEndian.Uint16(rect[2:]) == 0) {
+				fb.Width, fb.Height = w, h
+				if max := fb.MaxServerMessage(); max > m.max {
+					m.max = max
+				}
+			}
+			m.rect(enc, w, h, fb.PixelFormat)
+		}
+	case rfbSetColourMapEntries:
+		hdr := m.read(6)
+		m.skip(6 * int(binary.BigEndian.Uint16(hdr[4:])))
+	case rfbBell, rfbEndOfContinuousUpdates:
+		m.read(1)
+	case rfbServerCutText:
+		hdr := m.read(8)
+		l, err := rfbCutTextLength(hdr[4:])
+		if err != nil {
+			return nil, err
+		}
+		m.skip(l)
+	case rfbServerFence:
+		hdr := m.read(9)
+		m.skip(int(hdr[8]))
+	case rfbServerXVP:
+		m.read(4)
+	default:
+		return nil, fmt.Errorf("unsupported server message type %d", t[0])
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.buf, nil
+}
+
+// rfbMessageReader reads a message into a buffer. Errors are sticky, and reads
+// after an error return zeros.
+type rfbMessageReader struct {
+	r   *bufio.Reader
+	max int
+	buf []byte
+	err error
+}
+
+// read reads n more bytes of the message and returns them.
+func (m *rfbMessageReader) read(n int) []byte {
+	if m.skip(n); m.err != nil {
+		return make([]byte, n)
+	}
+	return m.buf[len(m.buf)-n:]
+}
+
+// skip reads n more bytes of the message.
+func (m *rfbMessageReader) skip(n int) {
+	if m.err != nil {
+		return
+	}
+	if n < 0 || len(m.buf)+n > m.max {
+		m.err = errors.New("message too long")
+		return
+	}
+	l := len(m.buf)
+	if cap(m.buf) < l+n {
+		buf := make([]byte, l, l+n+512)
+		copy(buf, m.buf)
+		m.buf = buf
+	}
+	m.buf = m.buf[:l+n]
+	if _, err := io.ReadFull(m.r, m.buf[l:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		m.err = err
+	}
+}
+
+// rect reads the data for a framebuffer update rectangle.
+func (m *rfbMessageReader) rect(enc int32, w, h int, pf rfbPixelFormat) {
+	bpp := pf.BytesPerPixel()
+	switch enc {
+	case rfbEncRaw:
+		m.skip(w * h * bpp)
+	case rfbEncCopyRect:
+		m.skip(4)
+	case rfbEncRRE:
+		n := int(binary.BigEndian.Uint32(m.read(4)))
+		m.skip(bpp + n*(bpp+8))
+	case rfbEncCoRRE:
+		n := int(binary.BigEndian.Uint32(m.read(4)))
+		m.skip(bpp + n*(bpp+4))
+	case rfbEncHextile:
+		m.hextile(w, h, bpp)
+	case rfbEncZlib, rfbEncZRLE:
+		m.skip(int(binary.BigEndian.Uint32(m.read(4))))
+	case rfbEncTight:
+		m.tight(w, h, pf)
+	case rfbEncCursor:
+		m.skip(w*h*bpp + (w+7)/8*h)
+	case rfbEncXCursor:
+		if w*h != 0 {
+			m.skip(6 + 2*((w+7)/8)*h)
+		}
+	case rfbEncDesktopSize, rfbEncQEMUExtendedKeyEvent, rfbEncXVP, rfbEncFence, rfbEncContinuousUpdates:
+		// no data
+	case rfbEncExtendedDesktopSize:
+		m.skip(16 * int(m.read(4)[0]))
+	case rfbEncDesktopName:
+		m.skip(int(binary.BigEndian.Uint32(m.read(4))))
+	default:
+		if m.err == nil {
+			m.err = fmt.Errorf("unsupported encoding %d", enc)
+		}
+	}
+}
+
+// hextile reads the data for a Hextile rectangle.
+func (m *rfbMessageReader) hextile(w, h, bpp int) {
+	for y := 0; y < h; y += 16 {
+		for x := 0; x < w; x += 16 {
+			if m.err != nil {
+				return
+			}
+			tw, th := 16, 16
+			if w-x < 16 {
+				tw = w - x
+			}
+			if h-y < 16 {
+				th = h - y
+			}
+			sub := m.read(1)[0]
+			if sub&1 != 0 { // Raw
+				m.skip(tw * th * bpp)
+				continue
+			}
+			if sub&2 != 0 { // BackgroundSpecified
+				m.skip(bpp)
+			}
+			if sub&4 != 0 { // ForegroundSpecified
+				m.skip(bpp)
+			}
+			if sub&8 != 0 { // AnySubrects
+				n := int(m.read(1)[0])
+				if sub&16 != 0 { // SubrectsColoured
+					m.skip(n * (bpp + 2))
+				} else {
+					m.skip(n * 2)
+				}
+			}
+		}
+	}
+}
+
+// tight reads the data for a Tight rectangle.
+func (m *rfbMessageReader) tight(w, h int, pf rfbPixelFormat) {
+	tpp := pf.TightBytesPerPixel()
+	switch ctl := m.read(1)[0] >> 4; {
+	case ctl == 0x8: // FillCompression
+		m.skip(tpp)
+	case ctl == 0x9: // JpegCompression
+		m.skip(m.compactLength())
+	case ctl&0x8 != 0:
+		if m.err == nil {
+			m.err = fmt.Errorf("unsupported tight compression type %#x", ctl)
+		}
+	default: // BasicCompression
+		var filter uint8
+		if ctl&0x4 != 0 {
+			filter = m.read(1)[0]
+		}
+		size := w * h * tpp
+		switch filter {
+		case 0: // CopyFilter
+		case 1: // PaletteFilter
+			n := int(m.read(1)[0]) + 1
+			m.skip(n * tpp)
+			if n <= 2 {
+				size = (w + 7) / 8 * h
+			} else {
+				size = w * h
+			}
+		case 2: // GradientFilter
+		default:
+			if m.err == nil {
+				m.err = fmt.Errorf("unsupported tight filter %d", filter)
+			}
+			return
+		}
+		if size < 12 {
+			m.skip(size)
+		} else {
+			m.skip(m.compactLength())
+		}
+	}
+}
+
+// compactLength reads a Tight compact length.
+func (m *rfbMessageReader) compactLength() int {
+	var n int
+	for i := 0; i < 3; i++ {
+		b := m.read(1)[0]
+		if i == 2 {
+			n |= int(b) << 14
+			break
+		}
+		n |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return n
+}
+
+// rfbSecurityNames contains the names of known RFB security types.
+var rfbSecurityNames = map[uint8]string{
+	rfbSecNone:    "None",
+	rfbSecVNCAuth: "VNC",
+	5:             "RA2",
+	6:             "RA2ne",
+	16:            "Tight",
+	17:            "Ultra",
+	18:            "TLS",
+	19:            "VeNCrypt",
+	20:            "SASL",
+	21:            "MD5",
+	22:            "xvp",
+	30:            "ARD",
+	113:           "MSLogonII",
+}
+
+// rfbSecurityName returns a human-readable name for a security type.
+func rfbSecurityName(t uint8) string {
+	if n, ok := rfbSecurityNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("Unknown(%d)", t)
+}
+
+// rfbMaxReason is the maximum length of a failure reason which will be
+// accepted.
+const rfbMaxReason = 1 << 16
+
+// rfbMaxName is the maximum length of a desktop name which will be accepted.
+const rfbMaxName = 1 << 16
+
+// rfbStage is a point in the handshake at which policies are checked.
+type rfbStage int
+
+const (
+	// rfbStageVersion is after the server's ProtocolVersion has been read,
+	// but before it has been sent to the client. Only RawVersion and
+	// ServerVersion (if it was valid) are set.
+	rfbStageVersion rfbStage = iota
+	// rfbStageSecurity is after the security types offered by the server
+	// have been read, but before they have been sent to the client.
+	rfbStageSecurity
+	// rfbStageServerInit is after the ServerInit has been read, but before it
+	// has been sent to the client.
+	rfbStageServerInit
+)
+
+// rfbHandshake contains information about a RFB handshake. Fields are filled
+// in as the handshake progresses.
+type rfbHandshake struct {
+	RawVersion    []byte
+	ServerVersion rfbVersion
+	ClientVersion rfbVersion
+	Version       int // negotiated minor version (3, 7, or 8)
+
+	SecurityTypes []uint8 // offered by the server
+	SecurityType  uint8   // chosen by the client (or the server for 3.3)
+
+	// PasswordInjected is true if the proxy authenticated with the server
+	// itself, in which case SecurityType is the one used with the server.
+	PasswordInjected bool
+
+	Shared bool // as sent to the server
+
+	Width, Height uint16
+	PixelFormat   rfbPixelFormat
+	Name          string
+
+	// Passthrough is true if the handshake could not be followed to the end
+	// (e.g. for an unsupported security type), in which case the rest of the
+	// connection is proxied as-is.
+	Passthrough bool
+}
+
+// ServerInit returns the ServerInit message for the handshake.
+func (h *rfbHandshake) ServerInit() []byte {
+	buf := make([]byte, 24, 24+len(h.Name))
+	binary.BigEndian.PutUint16(buf[0:], h.Width)
+	binary.BigEndian.PutUint16(buf[2:], h.Height)
+	copy(buf[4:20], h.PixelFormat[:])
+	binary.BigEndian.PutUint32(buf[20:], uint32(len(h.Name)))
+	return append(buf, h.Name...)
+}
+
+func (h *rfbHandshake) String() string {
+	var b strings.Builder
+	if h.Version == 0 {
+		fmt.Fprintf(&b, "version %q", h.RawVersion)
+	} else {
+		fmt.Fprintf(&b, "RFB %s/%s", h.ServerVersion, h.ClientVersion)
+	}
+	if len(h.SecurityTypes) != 0 {
+		b.WriteString(", security types")
+		for _, t := range h.SecurityTypes {
+			b.WriteString(" ")
+			b.WriteString(rfbSecurityName(t))
+		}
+	}
+	if h.SecurityType != rfbSecInvalid {
+		fmt.Fprintf(&b, ", using %s", rfbSecurityName(h.SecurityType))
+		if h.PasswordInjected {
+			b.WriteString(" (injected)")
+		}
+	}
+	if h.Width != 0 || h.Height != 0 || h.Name != "" {
+		fmt.Fprintf(&b, ", desktop %dx%d %q", h.Width, h.Height, h.Name)
+	}
+	if h.Passthrough {
+		b.WriteString(", passthrough")
+	}
+	return b.String()
+}
+
+// rfbPolicy checks a handshake at each stage.
+type rfbPolicy struct {
+	Reason string // for the rejected connections metric
+	Check  func(h *rfbHandshake, stage rfbStage) error
+}
+
+// rfbPolicyError is returned when a handshake is rejected by a policy.
+type rfbPolicyError struct {
+	Reason string
+	Err    error
+}
+
+func (err *rfbPolicyError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *rfbPolicyError) Unwrap() error {
+	return err.Err
+}
+
+// rfbMagicPolicy rejects servers which don't start with the provided magic
+// bytes.
+func rfbMagicPolicy(magic []byte) rfbPolicy {
+	return rfbPolicy{rejectMagic, func(h *rfbHandshake, stage rfbStage) error {
+		if stage == rfbStageVersion && !bytes.HasPrefix(h.RawVersion, magic) {
+			return fmt.Errorf("not a VNC server (got %q)", h.RawVersion)
+		}
+		return nil
+	}}
+}
+
+// rfbVersionPolicy rejects servers which send an invalid ProtocolVersion.
+var rfbVersionPolicy = rfbPolicy{rejectVersion, func(h *rfbHandshake, stage rfbStage) error {
+	if stage == rfbStageVersion {
+		_, err := parseRFBVersion(h.RawVersion)
+		return err
+	}
+	return nil
+}}
+
+// rfbConn is one side of a proxied RFB connection.
+type rfbConn struct {
+	*bufio.Reader
+	io.Writer
+}
+
+// rfbProxy relays RFB handshakes, parsing them and enforcing policies along
+// the way.
+type rfbProxy struct {
+	Policies []rfbPolicy
+
+	// Password, if not nil, is used to authenticate with the server, and the
+	// client is offered the None security type instead of the server's ones.
+	Password []byte
+
+	// ViewOnly, if true, drops input messages from the client.
+	ViewOnly bool
+
+	// NoClipboardToServer and NoClipboardToClient, if true, drop clipboard
+	// text sent in that direction.
+	NoClipboardToServer bool
+	NoClipboardToClient bool
+
+	// ClipboardMaxSize, if not zero, drops clipboard text longer than it.
+	ClipboardMaxSize int
+
+	// ClipboardAudit, if not nil, is called with all clipboard text and
+	// whether it was allowed.
+	ClipboardAudit func(toServer bool, text []byte, allowed bool)
+
+	// ForceShared and ForceExclusive, if true, replace the shared flag sent
+	// by the client in the ClientInit.
+	ForceShared    bool
+	ForceExclusive bool
+}
+
+// Handshake relays the handshake between the client and the server. The
+// returned rfbHandshake is never nil, and contains as much information as was
+// parsed before any error. If the error is a policy violation, it will be a
+// *rfbPolicyError. After a successful handshake, the rest of the connection
+// can be proxied as-is.
+func (p rfbProxy) Handshake(c, s rfbConn) (*rfbHandshake, error) {
+	h := new(rfbHandshake)
+
+	buf, err := readFull(s, 12)
+	if err != nil {
+		return h, fmt.Errorf("read server version: %w", err)
+	}
+	h.RawVersion = buf
+	sv, verr := parseRFBVersion(buf)
+	if verr == nil {
+		h.ServerVersion = sv
+	}
+	if err := p.check(h, rfbStageVersion); err != nil {
+		return h, err
+	}
+	if verr != nil && p.followsHandshake() {
+		return h, fmt.Errorf("can't follow handshake: %w", verr)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return h, err
+	}
+	if verr != nil {
+		h.Passthrough = true
+		return h, nil
+	}
+
+	if buf, err = readFull(c, 12); err != nil {
+		return h, fmt.Errorf("read client version: %w", err)
+	}
+	cv, err := parseRFBVersion(buf)
+	if err != nil {
+		return h, fmt.Errorf("client: %w", err)
+	}
+	h.ClientVersion = cv
+	if h.Version = cv.Negotiated(); sv.Negotiated() < h.Version {
+		h.Version = sv.Negotiated()
+	}
+	if _, err := s.Write(buf); err != nil {
+		return h, err
+	}
+
+	if p.Password != nil {
+		err = p.injectSecurity(h, c, s)
+	} else {
+		err = p.relaySecurity(h, c, s)
+	}
+	if err != nil || h.Passthrough {
+		return h, err
+	}
+
+	if buf, err = readFull(c, 1); err != nil {
+		return h, fmt.Errorf("read client init: %w", err)
+	}
+	switch {
+	case p.ForceShared:
+		buf[0] = 1
+	case p.ForceExclusive:
+		buf[0] = 0
+	}
+	h.Shared = buf[0] != 0
+	if _, err := s.Write(buf); err != nil {
+		return h, err
+	}
+
+	if err := p.readServerInit(h, s); err != nil {
+		return h, err
+	}
+	if _, err := c.Write(h.ServerInit()); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// readServerInit reads the ServerInit and checks it against the policies.
+func (p rfbProxy) readServerInit(h *rfbHandshake, s rfbConn) error {
+	buf, err := readFull(s, 24)
+	if err != nil {
+		return fmt.Errorf("read server init: %w", err)
+	}
+	n := binary.BigEndian.Uint32(buf[20:])
+	if n > rfbMaxName {
+		return fmt.Errorf("desktop name too long (%d bytes)", n)
+	}
+	name, err := readFull(s, int(n))
+	if err != nil {
+		return fmt.Errorf("read server init: %w", err)
+	}
+	h.Width, h.Height = binary.BigEndian.Uint16(buf[0:]), binary.BigEndian.Uint16(buf[2:])
+	copy(h.PixelFormat[:], buf[4:20])
+	h.Name = string(name)
+	return p.check(h, rfbStageServerInit)
+}
+
+// relaySecurity relays the security handshake between the client and the
+// server.
+func (p rfbProxy) relaySecurity(h *rfbHandshake, c, s rfbConn) error {
+	var buf []byte
+	var err error
+
+	if h.Version == 3 {
+		// the server decides
+		if buf, err = readFull(s, 4); err != nil {
+			return fmt.Errorf("read security type: %w", err)
+		}
+		t := binary.BigEndian.Uint32(buf)
+		if t > 255 {
+			return fmt.Errorf("invalid security type %d", t)
+		}
+		if t != uint32(rfbSecInvalid) {
+			h.SecurityTypes = []uint8{uint8(t)}
+			if err := p.check(h, rfbStageSecurity); err != nil {
+				return err
+			}
+			if len(p.supportedSecurity(h.SecurityTypes)) == 0 {
+				return p.fail(h, c, "connection failed", "unsupported security type "+rfbSecurityName(uint8(t)))
+			}
+		}
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+		if t == uint32(rfbSecInvalid) {
+			return p.relayFailure(c, s, "connection failed")
+		}
+		h.SecurityType = uint8(t)
+	} else {
+		if buf, err = readFull(s, 1); err != nil {
+			return fmt.Errorf("read security types: %w", err)
+		}
+		if buf[0] == 0 {
+			if _, err := c.Write(buf); err != nil {
+				return err
+			}
+			return p.relayFailure(c, s, "connection failed")
+		}
+		types, err := readFull(s, int(buf[0]))
+		if err != nil {
+			return fmt.Errorf("read security types: %w", err)
+		}
+		h.SecurityTypes = types
+		if err := p.check(h, rfbStageSecurity); err != nil {
+			return err
+		}
+		if types = p.supportedSecurity(types); len(types) == 0 {
+			return p.fail(h, c, "connection failed", "no supported security types")
+		}
+		if _, err := c.Write(append([]byte{uint8(len(types))}, types...)); err != nil {
+			return err
+		}
+		if buf, err = readFull(c, 1); err != nil {
+			return fmt.Errorf("read chosen security type: %w", err)
+		}
+		if bytes.IndexByte(types, buf[0]) == -1 {
+			return fmt.Errorf("client chose security type %s, which wasn't offered", rfbSecurityName(buf[0]))
+		}
+		h.SecurityType = buf[0]
+		if _, err := s.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	switch h.SecurityType {
+	case rfbSecNone:
+		if h.Version == 8 {
+			if err := p.relaySecurityResult(h, c, s); err != nil {
+				return err
+			}
+		}
+	case rfbSecVNCAuth:
+		if err := relayFull(c, s, 16); err != nil {
+			return fmt.Errorf("relay challenge: %w", err)
+		}
+		if err := relayFull(s, c, 16); err != nil {
+			return fmt.Errorf("relay response: %w", err)
+		}
+		if err := p.relaySecurityResult(h, c, s); err != nil {
+			return err
+		}
+	default:
+		h.Passthrough = true
+	}
+	return nil
+}
+
+// supportedSecurity filters the security types which can be offered to the
+// client. If the rest of the handshake or the messages need to be followed,
+// only the ones the proxy can follow are supported.
+func (p rfbProxy) supportedSecurity(types []uint8) []uint8 {
+	if !p.followsHandshake() {
+		return types
+	}
+	var res []uint8
+	for _, t := range types {
+		if t == rfbSecNone || t == rfbSecVNCAuth {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// injectSecurity completes the security handshake with the server using the
+// password, and offers the None security type to the client.
+func (p rfbProxy) injectSecurity(h *rfbHandshake, c, s rfbConn) error {
+	if err := p.authenticate(h, s); err != nil {
+		if f, ok := err.(*rfbFailure); ok {
+			return p.fail(h, c, f.What, f.Reason)
+		}
+		return err
+	}
+
+	if h.Version == 3 {
+		_, err := c.Write([]byte{0, 0, 0, rfbSecNone})
+		return err
+	}
+	if _, err := c.Write([]byte{1, rfbSecNone}); err != nil {
+		return err
+	}
+	buf, err := readFull(c, 1)
+	if err != nil {
+		return fmt.Errorf("read chosen security type: %w", err)
+	}
+	if buf[0] != rfbSecNone {
+		return fmt.Errorf("client chose security type %s, which wasn't offered", rfbSecurityName(buf[0]))
+	}
+	if h.Version == 8 {
+		if _, err := c.Write([]byte{0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rfbFailure is a failure reason which should be passed on to the client.
+type rfbFailure struct {
+	What   string
+	Reason string
+}
+
+func (f *rfbFailure) Error() string {
+	return fmt.Sprintf("%s: %q", f.What, f.Reason)
+}
+
+// authenticate completes the security handshake with the server on behalf of
+// the client, using VNC authentication if there is a password, or None
+// otherwise. If the server or proxy rejects the connection, the error is a
+// *rfbFailure.
+func (p rfbProxy) authenticate(h *rfbHandshake, s rfbConn) error {
+	h.PasswordInjected = true
+
+	if h.Version == 3 {
+		buf, err := readFull(s, 4)
+		if err != nil {
+			return fmt.Errorf("read security type: %w", err)
+		}
+		t := binary.BigEndian.Uint32(buf)
+		if t > 255 {
+			return fmt.Errorf("invalid security type %d", t)
+		}
+		if t == uint32(rfbSecInvalid) {
+			return readFailure(s, "connection failed")
+		}
+		h.SecurityTypes = []uint8{uint8(t)}
+	} else {
+		buf, err := readFull(s, 1)
+		if err != nil {
+			return fmt.Errorf("read security types: %w", err)
+		}
+		if buf[0] == 0 {
+			return readFailure(s, "connection failed")
+		}
+		if h.SecurityTypes, err = readFull(s, int(buf[0])); err != nil {
+			return fmt.Errorf("read security types: %w", err)
+		}
+	}
+	if err := p.check(h, rfbStageSecurity); err != nil {
+		return err
+	}
+
+	hasVNCAuth := bytes.IndexByte(h.SecurityTypes, rfbSecVNCAuth) != -1
+	hasNone := bytes.IndexByte(h.SecurityTypes, rfbSecNone) != -1
+	switch {
+	case hasVNCAuth && p.Password != nil:
+		h.SecurityType = rfbSecVNCAuth
+	case hasNone:
+		h.SecurityType = rfbSecNone
+	case p.Password != nil:
+		return &rfbFailure{"connection failed", "server does not support VNC authentication"}
+	default:
+		return &rfbFailure{"connection failed", "server requires authentication"}
+	}
+	if h.Version != 3 {
+		if _, err := s.Write([]byte{h.SecurityType}); err != nil {
+			return err
+		}
+	}
+
+	if h.SecurityType == rfbSecVNCAuth {
+		challenge, err := readFull(s, 16)
+		if err != nil {
+			return fmt.Errorf("read challenge: %w", err)
+		}
+		response, err := rfbVNCAuthResponse(p.Password, challenge)
+		if err != nil {
+			return err
+		}
+		if _, err := s.Write(response); err != nil {
+			return err
+		}
+	}
+	if h.SecurityType == rfbSecVNCAuth || h.Version == 8 {
+		buf, err := readFull(s, 4)
+		if err != nil {
+			return fmt.Errorf("read security result: %w", err)
+		}
+		if binary.BigEndian.Uint32(buf) != 0 {
+			if h.Version == 8 {
+				return readFailure(s, "authentication failed")
+			}
+			return &rfbFailure{"authentication failed", "authentication failed"}
+		}
+	}
+	return nil
+}
+
+// ClientHandshake does the client side of a handshake with the server on
+// behalf of the proxy itself, authenticating with the password if needed.
+func (p rfbProxy) ClientHandshake(s rfbConn, shared bool) (*rfbHandshake, error) {
+	h := new(rfbHandshake)
+
+	buf, err := readFull(s, 12)
+	if err != nil {
+		return h, fmt.Errorf("read server version: %w", err)
+	}
+	h.RawVersion = buf
+	sv, verr := parseRFBVersion(buf)
+	if verr == nil {
+		h.ServerVersion = sv
+	}
+	if err := p.check(h, rfbStageVersion); err != nil {
+		return h, err
+	}
+	if verr != nil {
+		return h, verr
+	}
+
+	h.Version = sv.Negotiated()
+	h.ClientVersion = rfbVersion{3, h.Version}
+	if _, err := fmt.Fprintf(s, "RFB %03d.%03d\n", h.ClientVersion.Major, h.ClientVersion.Minor); err != nil {
+		return h, err
+	}
+
+	if err := p.authenticate(h, s); err != nil {
+		return h, err
+	}
+
+	h.Shared = shared
+	if shared {
+		_, err = s.Write([]byte{1})
+	} else {
+		_, err = s.Write([]byte{0})
+	}
+	if err != nil {
+		return h, err
+	}
+
+	if err := p.readServerInit(h, s); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// rfbServerHandshake does the server side of a RFB 3.3/3.7/3.8 handshake with
+// no authentication.
+func rfbServerHandshake(r *bufio.Reader, w io.Writer, serverInit []byte) error {
+	if _, err := io.WriteString(w, "RFB 003.008\n"); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	v, err := parseRFBVersion(buf)
+	if err != nil {
+		return err
+	}
+
+	if v.Negotiated() == 3 {
+		if _, err := w.Write([]byte{0, 0, 0, rfbSecNone}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := w.Write([]byte{1, rfbSecNone}); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return err
+		} else if buf[0] != rfbSecNone {
+			return fmt.Errorf("client chose unsupported security type %d", buf[0])
+		}
+		if v.Negotiated() == 8 {
+			if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := io.ReadFull(r, buf[:1]); err != nil { // ClientInit
+		return err
+	}
+	_, err = w.Write(serverInit)
+	return err
+}
+
+// followsHandshake returns true if the handshake must be followed to the end
+// rather than passed through after an unsupported security type.
+func (p rfbProxy) followsHandshake() bool {
+	return p.ForceShared || p.ForceExclusive || p.filtersClient()
+}
+
+// rfbRefuse does the server side of a handshake with the client to tell it why
+// the connection failed.
+func rfbRefuse(c rfbConn, reason string) error {
+	if _, err := io.WriteString(c, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	buf, err := readFull(c, 12)
+	if err != nil {
+		return fmt.Errorf("read client version: %w", err)
+	}
+	v, err := parseRFBVersion(buf)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	if v.Negotiated() == 3 {
+		_, err = c.Write([]byte{0, 0, 0, 0})
+	} else {
+		_, err = c.Write([]byte{0})
+	}
+	if err != nil {
+		return err
+	}
+	return writeReason(c, []byte(reason))
+}
+
+// filtersClient returns true if client messages need to be parsed after the
+// handshake.
+func (p rfbProxy) filtersClient() bool {
+	return p.ViewOnly || p.filtersServer()
+}
+
+// filtersServer returns true if server messages need to be parsed after the
+// handshake.
+func (p rfbProxy) filtersServer() bool {
+	return p.NoClipboardToServer || p.NoClipboardToClient || p.ClipboardMaxSize != 0 || p.ClipboardAudit != nil
+}
+
+// filterClient returns the message to send to the server in place of a client
+// message, or nil if it should be dropped.
+func (p rfbProxy) filterClient(m rfbClientMessage, st *rfbState) rfbClientMessage {
+	if p.ViewOnly {
+		switch m.Type() {
+		case rfbKeyEvent, rfbPointerEvent, rfbClientCutText, rfbQEMU, rfbXVP, rfbSetDesktopSize:
+			return nil
+		}
+	}
+	if pf, ok := m.PixelFormat(); ok {
+		st.SetPixelFormat(pf)
+	}
+	if p.filtersServer() {
+		if encs, ok := m.Encodings(); ok {
+			// only allow encodings which can be parsed, and don't allow the
+			// extended clipboard since it is compressed
+			var res []int32
+			for _, enc := range encs {
+				if rfbParsableEncoding(enc) {
+					res = append(res, enc)
+				}
+			}
+			return newRFBSetEncodings(res)
+		}
+		if text, extended, ok := m.CutText(); ok && (extended || !p.allowClipboard(true, text)) {
+			return nil
+		}
+	}
+	return m
+}
+
+// allowClipboard checks whether clipboard text can be sent to the server or
+// client, and audits it.
+func (p rfbProxy) allowClipboard(toServer bool, text []byte) bool {
+	allowed := !(toServer && p.NoClipboardToServer) && !(!toServer && p.NoClipboardToClient)
+	if p.ClipboardMaxSize != 0 && len(text) > p.ClipboardMaxSize {
+		allowed = false
+	}
+	if p.ClipboardAudit != nil {
+		p.ClipboardAudit(toServer, text, allowed)
+	}
+	return allowed
+}
+
+// CopyClient copies messages from the client to the server after the
+// handshake, dropping ones which aren't allowed. It only needs to be used if
+// filtersClient is true.
+func (p rfbProxy) CopyClient(s io.Writer, c *bufio.Reader, st *rfbState) error {
+	bw := bufio.NewWriter(s)
+	for {
+		m, err := readRFBClientMessage(c)
+		if err != nil {
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			return err
+		}
+		if m = p.filterClient(m, st); m != nil {
+			bw.Write(m)
+		}
+		if c.Buffered() == 0 {
+			// don't hold on to messages while waiting for more
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CopyServer copies messages from the server to the client after the
+// handshake, dropping ones which aren't allowed. It only needs to be used if
+// filtersServer is true.
+func (p rfbProxy) CopyServer(c io.Writer, s *bufio.Reader, st *rfbState) error {
+	bw := bufio.NewWriter(c)
+	for {
+		fb := st.Framebuffer()
+		m, err := readRFBServerMessage(s, &fb)
+		st.SetSize(fb.Width, fb.Height)
+		if err != nil {
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			return err
+		}
+		if text, extended, ok := m.CutText(); !ok || (!extended && p.allowClipboard(false, text)) {
+			bw.Write(m)
+		}
+		if s.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rfbState is the state of a proxied connection after the handshake, which is
+// shared between both directions.
+type rfbState struct {
+	mu sync.Mutex
+	fb rfbFramebuffer
+}
+
+// newRFBState creates the state for a connection after the handshake.
+func newRFBState(h *rfbHandshake) *rfbState {
+	return &rfbState{fb: rfbFramebuffer{h.PixelFormat, int(h.Width), int(h.Height)}}
+}
+
+// Framebuffer returns the current pixel format and framebuffer size.
+func (st *rfbState) Framebuffer() rfbFramebuffer {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.fb
+}
+
+// SetSize updates the framebuffer size after the server resizes it.
+func (st *rfbState) SetSize(w, h int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.fb.Width, st.fb.Height = w, h
+}
+
+// SetPixelFormat updates the pixel format after the client changes it.
+func (st *rfbState) SetPixelFormat(pf rfbPixelFormat) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.fb.PixelFormat = pf
+}
+
+// check checks the handshake against the policies.
+func (p rfbProxy) check(h *rfbHandshake, stage rfbStage) error {
+	for _, policy := range p.Policies {
+		if err := policy.Check(h, stage); err != nil {
+			return &rfbPolicyError{policy.Reason, err}
+		}
+	}
+	return nil
+}
+
+// relaySecurityResult relays a SecurityResult message, returning an error if
+// it was unsuccessful.
+func (p rfbProxy) relaySecurityResult(h *rfbHandshake, c, s rfbConn) error {
+	buf, err := readFull(s, 4)
+	if err != nil {
+		return fmt.Errorf("read security result: %w", err)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf) != 0 {
+		if h.Version == 8 {
+			return p.relayFailure(c, s, "authentication failed")
+		}
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// relayFailure relays a failure reason from the server and returns it as an
+// error.
+func (p rfbProxy) relayFailure(c, s rfbConn, what string) error {
+	reason, err := readReason(s)
+	if err != nil {
+		return fmt.Errorf("%s: read reason: %w", what, err)
+	}
+	if err := writeReason(c, reason); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %q", what, reason)
+}
+
+// readFailure reads a failure reason from the server.
+func readFailure(s rfbConn, what string) error {
+	reason, err := readReason(s)
+	if err != nil {
+		return fmt.Errorf("%s: read reason: %w", what, err)
+	}
+	return &rfbFailure{what, string(reason)}
+}
+
+// fail sends a failure reason to the client in place of the security types
+// and returns it as an error.
+func (p rfbProxy) fail(h *rfbHandshake, c rfbConn, what, reason string) error {
+	msg := []byte{rfbSecInvalid}
+	if h.Version == 3 {
+		msg = []byte{0, 0, 0, rfbSecInvalid}
+	}
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	if err := writeReason(c, []byte(reason)); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %q", what, reason)
+}
+
+// readReason reads a failure reason.
+func readReason(r io.Reader) ([]byte, error) {
+	buf, err := readFull(r, 4)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(buf)
+	if n > rfbMaxReason {
+		return nil, fmt.Errorf("reason too long (%d bytes)", n)
+	}
+	return readFull(r, int(n))
+}
+
+// writeReason writes a failure reason.
+func writeReason(w io.Writer, reason []byte) error {
+	buf := make([]byte, 4, 4+len(reason))
+	binary.BigEndian.PutUint32(buf, uint32(len(reason)))
+	_, err := w.Write(append(buf, reason...))
+	return err
+}
+
+// rfbVNCAuthResponse encrypts a VNC Authentication challenge with DES, using
+// the password (truncated or padded with zeros to 8 bytes, with the bits of
+// each byte reversed) as the key.
+func rfbVNCAuthResponse(password, challenge []byte) ([]byte, error) {
+	if len(challenge) != 16 {
+		return nil, errors.New("invalid challenge length")
+	}
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, 16)
+	block.Encrypt(response[:8], challenge[:8])
+	block.Encrypt(response[8:], challenge[8:])
+	return response, nil
+}
+
+// relayFull reads n bytes from src and writes them to dst.
+func relayFull(dst io.Writer, src io.Reader, n int) error {
+	buf, err := readFull(src, n)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(buf)
+	return err
+}
+
+// readFull reads exactly n bytes, returning io.ErrUnexpectedEOF if the reader
+// ended early (including before any bytes were read).
+func readFull(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseRFBVersion(t *testing.T) {
+	for _, c := range []struct {
+		In         string
+		Version    rfbVersion
+		Negotiated int
+		Error      bool
+	}{
+		{"RFB 003.003\n", rfbVersion{3, 3}, 3, false},
+		{"RFB 003.007\n", rfbVersion{3, 7}, 7, false},
+		{"RFB 003.008\n", rfbVersion{3, 8}, 8, false},
+		{"RFB 003.005\n", rfbVersion{3, 5}, 3, false},
+		{"RFB 003.889\n", rfbVersion{3, 889}, 8, false},
+		{"RFB 004.001\n", rfbVersion{4, 1}, 3, false},
+		{"RFB 003.008", rfbVersion{}, 0, true},
+		{"SSH-2.0-Open", rfbVersion{}, 0, true},
+	} {
+		v, err := parseRFBVersion([]byte(c.In))
+		if c.Error {
+			if err == nil {
+				t.Errorf("%q: expected error", c.In)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.In, err)
+		} else if v != c.Version {
+			t.Errorf("%q: expected %s, got %s", c.In, c.Version, v)
+		} else if n := v.Negotiated(); n != c.Negotiated {
+			t.Errorf("%q: expected negotiated 3.%d, got 3.%d", c.In, c.Negotiated, n)
+		}
+	}
+}
+
+func TestReadRFBClientMessage(t *testing.T) {
+	msgs := [][]byte{
+		append([]byte{rfbSetPixelFormat, 0, 0, 0}, make([]byte, 16)...),
+		{rfbSetEncodings, 0, 0, 2, 0, 0, 0, 7, 0xff, 0xff, 0xff, 0x21},
+		{rfbFramebufferUpdateReq, 1, 0, 0, 0, 0, 4, 0, 3, 0},
+		{rfbKeyEvent, 1, 0, 0, 0, 0, 0xff, 0x53},
+		{rfbPointerEvent, 1, 0, 10, 0, 20},
+		{rfbClientCutText, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't'},
+		{rfbClientCutText, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 1}, // extended
+		{rfbEnableContinuousUpdates, 1, 0, 0, 0, 0, 4, 0, 3, 0},
+		{rfbClientFence, 0, 0, 0, 0, 0, 0, 1, 2, 'h', 'i'},
+		{rfbXVP, 0, 1, 2},
+		append([]byte{rfbSetDesktopSize, 0, 4, 0, 3, 0, 1, 0}, make([]byte, 16)...),
+		{rfbQEMU, 0, 0, 1, 0, 0, 0, 0x20, 0, 0, 0, 57},
+	}
+
+	r := bufio.NewReader(bytes.NewReader(bytes.Join(msgs, nil)))
+	for i, exp := range msgs {
+		m, err := readRFBClientMessage(r)
+		if err != nil {
+			t.Fatalf("message %d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(m, exp) {
+			t.Errorf("message %d: expected %v, got %v", i, exp, []byte(m))
+		}
+	}
+	if _, err := readRFBClientMessage(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	for _, c := range []struct {
+		Index  int
+		Down   bool
+		Keysym uint32
+		OK     bool
+	}{
+		{3, true, 0xff53, true},
+		{4, false, 0, false},
+		{11, true, 0x20, true},
+	} {
+		down, keysym, ok := rfbClientMessage(msgs[c.Index]).KeyEvent()
+		if down != c.Down || keysym != c.Keysym || ok != c.OK {
+			t.Errorf("message %d: expected key event %t %#x %t, got %t %#x %t", c.Index, c.Down, c.Keysym, c.OK, down, keysym, ok)
+		}
+	}
+
+	for _, c := range [][]byte{
+		{rfbKeyEvent, 1, 0},
+		{rfbSetEncodings, 0, 0, 2, 0, 0, 0, 7},
+		{rfbClientCutText, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff},
+		{rfbClientCutText, 0, 0, 0, 0x80, 0, 0, 0}, // -MinInt32 overflows
+		{rfbQEMU, 1, 0, 0},
+		{100},
+	} {
+		if _, err := readRFBClientMessage(bufio.NewReader(bytes.NewReader(c))); err == nil || err == io.EOF {
+			t.Errorf("%v: expected error, got %v", c, err)
+		}
+	}
+}
+
+func TestRFBHandshake(t *testing.T) {
+	for _, c := range []struct {
+		Name     string
+		SC, CS   []byte
+		Policies []rfbPolicy
+		Relayed  int // bytes of SC expected to be relayed to the client (-1 for all)
+		Error    string
+		Reason   string
+		Check    func(h *rfbHandshake) bool
+	}{
+		{"3.8None", join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{1}, []byte{1}), rfbPolicies, -1, "", "", func(h *rfbHandshake) bool {
+			return h.Version == 8 && h.SecurityType == rfbSecNone && h.Shared && h.Width == 4 && h.Height == 3 && h.Name == "test" && !h.Passthrough
+		}},
+		{"3.8VNCAuth", join("RFB 003.008\n", []byte{2, 2, 1}, make([]byte, 16), []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{2}, make([]byte, 16), []byte{0}), rfbPolicies, -1, "", "", func(h *rfbHandshake) bool {
+			return bytes.Equal(h.SecurityTypes, []byte{2, 1}) && h.SecurityType == rfbSecVNCAuth && !h.Shared && h.Name == "test"
+		}},
+		{"3.7None", join("RFB 003.008\n", []byte{1, 1}, testServerInit), join("RFB 003.007\n", []byte{1}, []byte{1}), rfbPolicies, -1, "", "", func(h *rfbHandshake) bool {
+			return h.Version == 7 && h.Name == "test"
+		}},
+		{"3.3VNCAuth", join("RFB 003.003\n", []byte{0, 0, 0, 2}, make([]byte, 16), []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", make([]byte, 16), []byte{1}), rfbPolicies, -1, "", "", func(h *rfbHandshake) bool {
+			return h.Version == 3 && h.SecurityType == rfbSecVNCAuth && h.Name == "test"
+		}},
+		{"Passthrough", join("RFB 003.008\n", []byte{1, 19}), join("RFB 003.008\n", []byte{19}), rfbPolicies, -1, "", "", func(h *rfbHandshake) bool {
+			return h.SecurityType == 19 && h.Passthrough
+		}},
+		{"PassthroughVersion", join("RFB 003.0a8\n"), nil, nil, -1, "", "", func(h *rfbHandshake) bool {
+			return h.Passthrough
+		}},
+		{"AuthFailed", join("RFB 003.008\n", []byte{1, 2}, make([]byte, 16), []byte{0, 0, 0, 1}, []byte{0, 0, 0, 3}, "bad"), join("RFB 003.008\n", []byte{2}, make([]byte, 16)), rfbPolicies, -1, "authentication failed: \"bad\"", "", nil},
+		{"Refused", join("RFB 003.008\n", []byte{0}, []byte{0, 0, 0, 2}, "no"), join("RFB 003.008\n"), rfbPolicies, -1, "connection failed: \"no\"", "", nil},
+		{"NotOffered", join("RFB 003.008\n", []byte{1, 2}), join("RFB 003.008\n", []byte{1}), rfbPolicies, -1, "wasn't offered", "", nil},
+		{"Truncated", join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit[:10]), join("RFB 003.008\n", []byte{1}, []byte{1}), rfbPolicies, 18, "unexpected EOF", "", nil},
+		{"Magic", join("SSH-2.0-Open"), nil, rfbPolicies, 0, "not a VNC server", rejectMagic, nil},
+		{"Version", join("RFB 003.0a8\n"), nil, rfbPolicies, 0, "invalid protocol version", rejectVersion, nil},
+		{"Policy", join("RFB 003.008\n", []byte{1, 1}), join("RFB 003.008\n"), []rfbPolicy{{"test", func(h *rfbHandshake, stage rfbStage) error {
+			if stage == rfbStageSecurity && bytes.IndexByte(h.SecurityTypes, rfbSecNone) != -1 {
+				return errors.New("no authentication")
+			}
+			return nil
+		}}}, 12, "no authentication", "test", nil},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var cb, sb bytes.Buffer
+			h, err := rfbProxy{Policies: c.Policies}.Handshake(
+				rfbConn{bufio.NewReader(bytes.NewReader(c.CS)), &cb},
+				rfbConn{bufio.NewReader(bytes.NewReader(c.SC)), &sb},
+			)
+			if h == nil {
+				t.Fatalf("expected handshake info to be returned")
+			}
+			if c.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Error) {
+					t.Errorf("expected error containing %q, got %v", c.Error, err)
+				}
+				var perr *rfbPolicyError
+				if errors.As(err, &perr) != (c.Reason != "") || (perr != nil && perr.Reason != c.Reason) {
+					t.Errorf("expected policy error with reason %q, got %#v", c.Reason, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if exp := c.SC; c.Relayed >= 0 {
+				if !bytes.Equal(cb.Bytes(), exp[:c.Relayed]) {
+					t.Errorf("expected %q to be relayed to the client, got %q", exp[:c.Relayed], cb.Bytes())
+				}
+			} else if !bytes.Equal(cb.Bytes(), exp) {
+				t.Errorf("expected %q to be relayed to the client, got %q", exp, cb.Bytes())
+			}
+			if c.Error == "" && !bytes.Equal(sb.Bytes(), c.CS) {
+				t.Errorf("expected %q to be relayed to the server, got %q", c.CS, sb.Bytes())
+			}
+			if c.Check != nil && !c.Check(h) {
+				t.Errorf("incorrect handshake info %+v", h)
+			}
+		})
+	}
+}
+
+func TestRFBHandshakePassword(t *testing.T) {
+	challenge := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	response := []byte{0xf1, 0x9b, 0x50, 0x47, 0x1f, 0x60, 0xf4, 0x22, 0x98, 0xe5, 0xc0, 0x14, 0x7d, 0xb5, 0x0e, 0x1e}
+
+	if r, err := rfbVNCAuthResponse([]byte("secret"), challenge); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if !bytes.Equal(r, response) {
+		t.Errorf("incorrect response %x", r)
+	}
+
+	for _, c := range []struct {
+		Name       string
+		SC, CS     []byte
+		ExpC, ExpS []byte
+		Error      string
+	}{
+		{"3.8VNCAuth",
+			join("RFB 003.008\n", []byte{2, 1, 2}, challenge, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{1}, []byte{1}),
+			join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{2}, response, []byte{1}), ""},
+		{"3.8None",
+			join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{1}, []byte{1}),
+			join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.008\n", []byte{1}, []byte{1}), ""},
+		{"3.7VNCAuth",
+			join("RFB 003.007\n", []byte{1, 2}, challenge, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.007\n", []byte{1}, []byte{0}),
+			join("RFB 003.007\n", []byte{1, 1}, testServerInit), join("RFB 003.007\n", []byte{2}, response, []byte{0}), ""},
+		{"3.3VNCAuth",
+			join("RFB 003.003\n", []byte{0, 0, 0, 2}, challenge, []byte{0, 0, 0, 0}, testServerInit), join("RFB 003.003\n", []byte{1}),
+			join("RFB 003.003\n", []byte{0, 0, 0, 1}, testServerInit), join("RFB 003.003\n", response, []byte{1}), ""},
+		{"3.8AuthFailed",
+			join("RFB 003.008\n", []byte{1, 2}, challenge, []byte{0, 0, 0, 1}, []byte{0, 0, 0, 3}, "bad"), join("RFB 003.008\n"),
+			join("RFB 003.008\n", []byte{0}, []byte{0, 0, 0, 3}, "bad"), join("RFB 003.008\n", []byte{2}, response), "authentication failed"},
+		{"3.7AuthFailed",
+			join("RFB 003.007\n", []byte{1, 2}, challenge, []byte{0, 0, 0, 1}), join("RFB 003.007\n"),
+			join("RFB 003.007\n", []byte{0}, []byte{0, 0, 0, 21}, "authentication failed"), join("RFB 003.007\n", []byte{2}, response), "authentication failed"},
+		{"3.3Refused",
+			join("RFB 003.003\n", []byte{0, 0, 0, 0}, []byte{0, 0, 0, 2}, "no"), join("RFB 003.003\n"),
+			join("RFB 003.003\n", []byte{0, 0, 0, 0}, []byte{0, 0, 0, 2}, "no"), join("RFB 003.003\n"), "connection failed"},
+		{"Unsupported",
+			join("RFB 003.008\n", []byte{1, 19}), join("RFB 003.008\n"),
+			nil, join("RFB 003.008\n"), "does not support VNC authentication"},
+		{"NotOffered",
+			join("RFB 003.008\n", []byte{1, 2}, challenge, []byte{0, 0, 0, 0}), join("RFB 003.008\n", []byte{2}),
+			join("RFB 003.008\n", []byte{1, 1}), join("RFB 003.008\n", []byte{2}, response), "wasn't offered"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var cb, sb bytes.Buffer
+			h, err := rfbProxy{Policies: rfbPolicies, Password: []byte("secret")}.Handshake(
+				rfbConn{bufio.NewReader(bytes.NewReader(c.CS)), &cb},
+				rfbConn{bufio.NewReader(bytes.NewReader(c.SC)), &sb},
+			)
+			if c.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Error) {
+					t.Errorf("expected error containing %q, got %v", c.Error, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !h.PasswordInjected || h.Name != "test" {
+				t.Errorf("incorrect handshake info %+v", h)
+			}
+			if c.ExpC != nil && !bytes.Equal(cb.Bytes(), c.ExpC) {
+				t.Errorf("expected %q to be sent to the client, got %q", c.ExpC, cb.Bytes())
+			}
+			if !bytes.Equal(sb.Bytes(), c.ExpS) {
+				t.Errorf("expected %q to be sent to the server, got %q", c.ExpS, sb.Bytes())
+			}
+		})
+	}
+}
+
+func TestRFBClientHandshake(t *testing.T) {
+	challenge := make([]byte, 16)
+	response, _ := rfbVNCAuthResponse([]byte("secret"), challenge)
+
+	for _, c := range []struct {
+		Name     string
+		Password []byte
+		SC       []byte
+		ExpS     []byte
+		Error    string
+	}{
+		{"3.8None", nil,
+			join("RFB 003.008\n", []byte{2, 2, 1}, []byte{0, 0, 0, 0}, testServerInit),
+			join("RFB 003.008\n", []byte{1}, []byte{1}), ""},
+		{"3.8VNCAuth", []byte("secret"),
+			join("RFB 003.008\n", []byte{2, 1, 2}, challenge, []byte{0, 0, 0, 0}, testServerInit),
+			join("RFB 003.008\n", []byte{2}, response, []byte{1}), ""},
+		{"3.889", nil,
+			join("RFB 003.889\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit),
+			join("RFB 003.008\n", []byte{1}, []byte{1}), ""},
+		{"3.3None", nil,
+			join("RFB 003.003\n", []byte{0, 0, 0, 1}, testServerInit),
+			join("RFB 003.003\n", []byte{1}), ""},
+		{"NoPassword", nil,
+			join("RFB 003.008\n", []byte{1, 2}),
+			join("RFB 003.008\n"), "requires authentication"},
+		{"Refused", nil,
+			join("RFB 003.008\n", []byte{0}, []byte{0, 0, 0, 2}, "no"),
+			join("RFB 003.008\n"), "connection failed"},
+		{"NotRFB", nil,
+			join("SSH-2.0-OpenSSH_8.0\r\n"),
+			nil, "not a VNC server"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var sb bytes.Buffer
+			h, err := rfbProxy{Policies: rfbPolicies, Password: c.Password}.ClientHandshake(rfbConn{bufio.NewReader(bytes.NewReader(c.SC)), &sb}, true)
+			if c.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Error) {
+					t.Errorf("expected error containing %q, got %v", c.Error, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if h.Name != "test" || h.Width != 4 || h.Height != 3 || !h.Shared {
+				t.Errorf("incorrect handshake info %+v", h)
+			} else if !bytes.Equal(h.ServerInit(), testServerInit) {
+				t.Errorf("expected ServerInit %v, got %v", testServerInit, h.ServerInit())
+			}
+			if !bytes.Equal(sb.Bytes(), c.ExpS) {
+				t.Errorf("expected %q to be sent to the server, got %q", c.ExpS, sb.Bytes())
+			}
+		})
+	}
+}
+
+func TestRFBViewOnly(t *testing.T) {
+	allowed := [][]byte{
+		append([]byte{rfbSetPixelFormat, 0, 0, 0}, make([]byte, 16)...),
+		{rfbSetEncodings, 0, 0, 1, 0, 0, 0, 7},
+		{rfbFramebufferUpdateReq, 1, 0, 0, 0, 0, 4, 0, 3, 0},
+		{rfbClientFence, 0, 0, 0, 0, 0, 0, 1, 0},
+	}
+	dropped := [][]byte{
+		{rfbKeyEvent, 1, 0, 0, 0, 0, 0xff, 0x53},
+		{rfbPointerEvent, 1, 0, 10, 0, 20},
+		{rfbClientCutText, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't'},
+		{rfbQEMU, 0, 0, 1, 0, 0, 0, 0x20, 0, 0, 0, 57},
+		{rfbXVP, 0, 1, 4},
+	}
+	var in, exp []byte
+	for i := range allowed {
+		in = append(in, allowed[i]...)
+		in = append(in, dropped[i]...)
+		exp = append(exp, allowed[i]...)
+	}
+	in = append(in, dropped[len(dropped)-1]...)
+
+	var buf bytes.Buffer
+	if err := (rfbProxy{ViewOnly: true}).CopyClient(&buf, bufio.NewReader(bytes.NewReader(in)), &rfbState{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("expected %v, got %v", exp, buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := (rfbProxy{}).CopyClient(&buf, bufio.NewReader(bytes.NewReader(in)), &rfbState{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if !bytes.Equal(buf.Bytes(), in) {
+		t.Errorf("expected messages to be copied as-is without view-only")
+	}
+
+	for _, c := range []struct {
+		Name   string
+		SC, CS []byte
+		ExpC   []byte
+		Error  bool
+	}{
+		{"Filtered", join("RFB 003.008\n", []byte{3, 19, 2, 16}), join("RFB 003.008\n", []byte{2}), join("RFB 003.008\n", []byte{1, 2}), false},
+		{"Unsupported", join("RFB 003.008\n", []byte{1, 19}), join("RFB 003.008\n"), nil, true},
+		{"Unsupported3.3", join("RFB 003.003\n", []byte{0, 0, 0, 19}), join("RFB 003.003\n"), nil, true},
+		{"Version", join("RFB 003.0a8\n"), nil, []byte{}, true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var cb, sb bytes.Buffer
+			_, err := rfbProxy{ViewOnly: true}.Handshake(
+				rfbConn{bufio.NewReader(bytes.NewReader(c.CS)), &cb},
+				rfbConn{bufio.NewReader(bytes.NewReader(c.SC)), &sb},
+			)
+			if c.Error && err == nil {
+				t.Errorf("expected error")
+			} else if !c.Error && err != io.ErrUnexpectedEOF && !strings.Contains(fmt.Sprint(err), "unexpected EOF") {
+				t.Errorf("expected handshake to continue, got %v", err)
+			}
+			if c.ExpC != nil && !bytes.HasPrefix(cb.Bytes(), c.ExpC) {
+				t.Errorf("expected %q to be sent to the client, got %q", c.ExpC, cb.Bytes())
+			}
+		})
+	}
+}
+
+func TestRFBShared(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		Proxy  rfbProxy
+		Client uint8
+		Exp    uint8
+	}{
+		{"Passthrough", rfbProxy{}, 0, 0},
+		{"Passthrough", rfbProxy{}, 1, 1},
+		{"ForceShared", rfbProxy{ForceShared: true}, 0, 1},
+		{"ForceShared", rfbProxy{ForceShared: true}, 1, 1},
+		{"ForceExclusive", rfbProxy{ForceExclusive: true}, 1, 0},
+		{"ForceExclusive", rfbProxy{ForceExclusive: true}, 0, 0},
+	} {
+		var cb, sb bytes.Buffer
+		h, err := c.Proxy.Handshake(
+			rfbConn{bufio.NewReader(bytes.NewReader(join("RFB 003.008\n", []byte{1}, []byte{c.Client}))), &cb},
+			rfbConn{bufio.NewReader(bytes.NewReader(join("RFB 003.008\n", []byte{1, 1}, []byte{0, 0, 0, 0}, testServerInit))), &sb},
+		)
+		if err != nil {
+			t.Errorf("%s %d: unexpected error: %v", c.Name, c.Client, err)
+		} else if exp := join("RFB 003.008\n", []byte{1}, []byte{c.Exp}); !bytes.Equal(sb.Bytes(), exp) {
+			t.Errorf("%s %d: expected %q to be sent to the server, got %q", c.Name, c.Client, exp, sb.Bytes())
+		} else if h.Shared != (c.Exp != 0) {
+			t.Errorf("%s %d: incorrect shared flag in handshake info", c.Name, c.Client)
+		}
+	}
+
+	// the handshake must be followed to rewrite the flag
+	var cb, sb bytes.Buffer
+	if _, err := (rfbProxy{ForceShared: true}).Handshake(
+		rfbConn{bufio.NewReader(bytes.NewReader(join("RFB 003.008\n"))), &cb},
+		rfbConn{bufio.NewReader(bytes.NewReader(join("RFB 003.008\n", []byte{1, 19}))), &sb},
+	); err == nil || !strings.Contains(err.Error(), "no supported security types") {
+		t.Errorf("expected unsupported security types to be rejected, got %v", err)
+	}
+}
+
+func TestRFBRefuse(t *testing.T) {
+	for _, c := range []struct {
+		Version string
+		Exp     []byte
+	}{
+		{"RFB 003.008\n", join("RFB 003.008\n", []byte{0}, []byte{0, 0, 0, 4}, "nope")},
+		{"RFB 003.003\n", join("RFB 003.008\n", []byte{0, 0, 0, 0}, []byte{0, 0, 0, 4}, "nope")},
+	} {
+		var cb bytes.Buffer
+		if err := rfbRefuse(rfbConn{bufio.NewReader(strings.NewReader(c.Version)), &cb}, "nope"); err != nil {
+			t.Errorf("%q: unexpected error: %v", c.Version, err)
+		} else if !bytes.Equal(cb.Bytes(), c.Exp) {
+			t.Errorf("%q: expected %q to be sent to the client, got %q", c.Version, c.Exp, cb.Bytes())
+		}
+	}
+}
+
+// testPixelFormat is a 32bpp true color pixel format.
+var testPixelFormat = rfbPixelFormat{32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0}
+
+func TestReadRFBServerMessage(t *testing.T) {
+	rect := func(w, h uint16, enc int32) []byte {
+		return []byte{0, 0, 0, 0, byte(w >> 8), byte(w), byte(h >> 8), byte(h), byte(uint32(enc) >> 24), byte(uint32(enc) >> 16), byte(uint32(enc) >> 8), byte(enc)}
+	}
+	msgs := [][]byte{
+		join([]byte{rfbFramebufferUpdate, 0, 0, 12},
+			rect(2, 2, rfbEncRaw), make([]byte, 16),
+			rect(2, 2, rfbEncCopyRect), make([]byte, 4),
+			rect(2, 2, rfbEncRRE), []byte{0, 0, 0, 1}, make([]byte, 4+4+8),
+			rect(17, 1, rfbEncHextile), []byte{1}, make([]byte, 16*4), []byte{2 | 8}, make([]byte, 4), []byte{1}, make([]byte, 2),
+			rect(2, 2, rfbEncZRLE), []byte{0, 0, 0, 3}, make([]byte, 3),
+			rect(2, 2, rfbEncTight), []byte{0x80}, make([]byte, 3),
+			rect(2, 1, rfbEncTight), []byte{0x00}, make([]byte, 6),
+			rect(10, 10, rfbEncTight), []byte{0x40, 1, 1}, make([]byte, 2*3), []byte{20}, make([]byte, 20),
+			rect(2, 2, rfbEncTight), []byte{0x90, 0xc8, 0x01}, make([]byte, 200),
+			rect(2, 2, rfbEncCursor), make([]byte, 16+2),
+			rect(2, 2, rfbEncDesktopSize),
+			rect(2, 2, rfbEncExtendedDesktopSize), []byte{1, 0, 0, 0}, make([]byte, 16),
+		),
+		join([]byte{rfbFramebufferUpdate, 0, 0xff, 0xff},
+			rect(0, 0, rfbEncDesktopName), []byte{0, 0, 0, 4}, "test",
+			rect(0, 0, rfbEncLastRect),
+		),
+		join([]byte{rfbSetColourMapEntries, 0, 0, 0, 0, 2}, make([]byte, 12)),
+		{rfbBell},
+		join([]byte{rfbServerCutText, 0, 0, 0, 0, 0, 0, 2}, "hi"),
+		join([]byte{rfbServerCutText, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc}, []byte{0, 0, 0, 1}),
+		{rfbEndOfContinuousUpdates},
+		{rfbServerFence, 0, 0, 0, 0, 0, 0, 1, 2, 'h', 'i'},
+		{rfbServerXVP, 0, 1, 1},
+	}
+
+	fb := &rfbFramebuffer{testPixelFormat, 4, 3}
+	r := bufio.NewReader(bytes.NewReader(bytes.Join(msgs, nil)))
+	for i, exp := range msgs {
+		m, err := readRFBServerMessage(r, fb)
+		if err != nil {
+			t.Fatalf("message %d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(m, exp) {
+			t.Errorf("message %d: expected %v, got %v", i, exp, []byte(m))
+		}
+	}
+	if _, err := readRFBServerMessage(r, fb); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if fb.Width != 2 || fb.Height != 2 {
+		t.Errorf("expected framebuffer to be resized to 2x2, got %dx%d", fb.Width, fb.Height)
+	}
+
+	if text, extended, ok := rfbServerMessage(msgs[4]).CutText(); !ok || extended || string(text) != "hi" {
+		t.Errorf("incorrect cut text %q %t %t", text, extended, ok)
+	}
+	if _, extended, ok := rfbServerMessage(msgs[5]).CutText(); !ok || !extended {
+		t.Errorf("expected extended cut text")
+	}
+
+	for _, c := range [][]byte{
+		join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(2, 2, 21), make([]byte, 100)),
+		join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(2, 2, rfbEncRaw), make([]byte, 15)),
+		join([]byte{rfbFramebufferUpdate, 0, 0, 2}, rect(2, 2, rfbEncCopyRect), make([]byte, 4)),
+		join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(2, 2, rfbEncTight), []byte{0xa0}),
+		{rfbServerCutText, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff},
+		{rfbServerCutText, 0, 0, 0, 0x80, 0, 0, 0}, // -MinInt32 overflows
+		{100},
+	} {
+		if _, err := readRFBServerMessage(bufio.NewReader(bytes.NewReader(c)), &rfbFramebuffer{testPixelFormat, 4, 3}); err == nil || err == io.EOF {
+			t.Errorf("%v: expected error, got %v", c, err)
+		}
+	}
+
+	// the size of updates is limited by the size of the framebuffer
+	for _, c := range []struct {
+		Width, Height int
+		Message       []byte
+		TooLong       bool
+	}{
+		{4, 3, join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(4096, 4096, rfbEncRaw)), true},
+		{4096, 4096, join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(4096, 4096, rfbEncRaw)), false},
+		{4, 3, join([]byte{rfbFramebufferUpdate, 0, 0, 2}, rect(4096, 4096, rfbEncDesktopSize), rect(4096, 4096, rfbEncRaw)), false},
+		{4, 3, join([]byte{rfbFramebufferUpdate, 0, 0, 2}, []byte{0, 0, 0, 1}, rect(4096, 4096, rfbEncExtendedDesktopSize)[4:], []byte{0, 0, 0, 0}, rect(4096, 4096, rfbEncRaw)), true},
+		{65535, 65535, join([]byte{rfbFramebufferUpdate, 0, 0, 1}, rect(65535, 65535, rfbEncRaw)), true},
+	} {
+		_, err := readRFBServerMessage(bufio.NewReader(bytes.NewReader(c.Message)), &rfbFramebuffer{testPixelFormat, c.Width, c.Height})
+		if tooLong := err != nil && strings.Contains(err.Error(), "too long"); tooLong != c.TooLong {
+			t.Errorf("%dx%d %v: expected too long %t, got %v", c.Width, c.Height, c.Message[:16], c.TooLong, err)
+		}
+	}
+}
+
+func TestRFBClipboard(t *testing.T) {
+	type audit struct {
+		ToServer bool
+		Text     string
+		Allowed  bool
+	}
+	var audited []audit
+	p := rfbProxy{
+		NoClipboardToClient: true,
+		ClipboardMaxSize:    4,
+		ClipboardAudit: func(toServer bool, text []byte, allowed bool) {
+			audited = append(audited, audit{toServer, string(text), allowed})
+		},
+	}
+	st := &rfbState{fb: rfbFramebuffer{testPixelFormat, 4, 3}}
+
+	var buf bytes.Buffer
+	in := join(
+		[]byte{rfbClientCutText, 0, 0, 0, 0, 0, 0, 2}, "hi",
+		[]byte{rfbSetEncodings, 0, 0, 3, 0, 0, 0, 7, 0, 0, 0, 21, 0xc0, 0xa1, 0xe5, 0xce},
+		[]byte{rfbClientCutText, 0, 0, 0, 0, 0, 0, 5}, "hello",
+		[]byte{rfbClientCutText, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc}, []byte{0, 0, 0, 1},
+		[]byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x20},
+	)
+	if err := p.CopyClient(&buf, bufio.NewReader(bytes.NewReader(in)), st); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if exp := join(
+		[]byte{rfbClientCutText, 0, 0, 0, 0, 0, 0, 2}, "hi",
+		[]byte{rfbSetEncodings, 0, 0, 1, 0, 0, 0, 7},
+		[]byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x20},
+	); !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("expected %v to be sent to the server, got %v", exp, buf.Bytes())
+	}
+
+	buf.Reset()
+	in = join(
+		[]byte{rfbBell},
+		[]byte{rfbServerCutText, 0, 0, 0, 0, 0, 0, 3}, "abc",
+		[]byte{rfbFramebufferUpdate, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}, make([]byte, 4),
+	)
+	if err := p.CopyServer(&buf, bufio.NewReader(bytes.NewReader(in)), st); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if exp := join(
+		[]byte{rfbBell},
+		[]byte{rfbFramebufferUpdate, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}, make([]byte, 4),
+	); !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("expected %v to be sent to the client, got %v", exp, buf.Bytes())
+	}
+
+	if exp := []audit{
+		{true, "hi", true},
+		{true, "hello", false},
+		{false, "abc", false},
+	}; fmt.Sprint(audited) != fmt.Sprint(exp) {
+		t.Errorf("expected audit %v, got %v", exp, audited)
+	}
+
+	if (rfbProxy{}).filtersServer() || !(rfbProxy{NoClipboardToServer: true}).filtersServer() || !(rfbProxy{NoClipboardToServer: true}).filtersClient() {
+		t.Errorf("incorrect filtersServer/filtersClient")
+	}
+}
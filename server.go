@@ -4,6 +4,10 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -11,10 +15,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"golang.org/x/net/websocket"
 )
@@ -26,157 +36,425 @@ import (
 var ipv6Regexp = `(?:(?:[0-9a-fA-F]{1,4}:){7,7}[0-9a-fA-F]{1,4}|(?:[0-9a-fA-F]{1,4}:){1,7}:|(?:[0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}|(?:[0-9a-fA-F]{1,4}:){1,5}(?::[0-9a-fA-F]{1,4}){1,2}|(?:[0-9a-fA-F]{1,4}:){1,4}(?::[0-9a-fA-F]{1,4}){1,3}|(?:[0-9a-fA-F]{1,4}:){1,3}(?::[0-9a-fA-F]{1,4}){1,4}|(?:[0-9a-fA-F]{1,4}:){1,2}(?::[0-9a-fA-F]{1,4}){1,5}|[0-9a-fA-F]{1,4}:(?:(?::[0-9a-fA-F]{1,4}){1,6})|:(?:(?::[0-9a-fA-F]{1,4}){1,7}|:)|fe80:(?::[0-9a-fA-F]{0,4}){0,4}%[0-9a-zA-Z]{1,}|::(?:ffff(?::0{1,4}){0,1}:){0,1}(?:(?:25[0-5]|(?:2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(?:25[0-5]|(?:2[0-4]|1{0,1}[0-9]){0,1}[0-9])|(?:[0-9a-fA-F]{1,4}:){1,4}:(?:(?:25[0-5]|(?:2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(?:25[0-5]|(?:2[0-4]|1{0,1}[0-9]){0,1}[0-9]))`
 
 func main() {
-	pflag.Usage = func() {
-		fmt.Printf("Usage: %s [options]\n\nOptions:\n", os.Args[0])
-		pflag.PrintDefaults()
-	}
-
-	arbitraryHosts := pflag.BoolP("arbitrary-hosts", "H", false, "Allow connection to other hosts")
-	arbitraryPorts := pflag.BoolP("arbitrary-ports", "P", false, "Allow connections to arbitrary ports (requires arbitrary-hosts)")
-	cidrWhitelist := pflag.StringSliceP("cidr-whitelist", "c", []string{}, "CIDR whitelist for when arbitrary hosts are enabled (comma separated) (conflicts with blacklist)")
-	cidrBlacklist := pflag.StringSliceP("cidr-blacklist", "C", []string{}, "CIDR blacklist for when arbitrary hosts are enabled (comma separated) (conflicts with whitelist)")
-	host := pflag.StringP("host", "h", "localhost", "The host/ip to connect to by default")
-	port := pflag.Uint16P("port", "p", 5900, "The port to connect to by default")
-	addr := pflag.StringP("addr", "a", ":8080", "The address to listen on")
-	basicUI := pflag.BoolP("basic-ui", "u", false, "Hide connection options from the main screen")
-	verbose := pflag.BoolP("verbose", "v", false, "Show extra log info")
-	noURLPassword := pflag.Bool("no-url-password", false, "Do not allow password in URL params")
-	novncParams := pflag.StringSlice("novnc-params", nil, "Extra URL params for noVNC (advanced) (comma separated key-value pairs) (e.g. resize=remote)")
-	defaultViewOnly := pflag.Bool("default-view-only", false, "Use view-only by default")
-	help := pflag.Bool("help", false, "Show this help text")
-
-	envmap := map[string]string{
-		"arbitrary-hosts":   "NOVNC_ARBITRARY_HOSTS",
-		"arbitrary-ports":   "NOVNC_ARBITRARY_PORTS",
-		"cidr-whitelist":    "NOVNC_CIDR_WHITELIST",
-		"cidr-blacklist":    "NOVNC_CIDR_BLACKLIST",
-		"host":              "NOVNC_HOST",
-		"port":              "NOVNC_PORT",
-		"addr":              "NOVNC_ADDR",
-		"basic-ui":          "NOVNC_BASIC_UI",
-		"no-url-password":   "NOVNC_NO_URL_PASSWORD",
-		"novnc-params":      "NOVNC_PARAMS",
-		"default-view-only": "NOVNC_DEFAULT_VIEW_ONLY",
-		"verbose":           "NOVNC_VERBOSE",
-	}
-
-	if val, ok := os.LookupEnv("PORT"); ok {
-		val = ":" + val
-		fmt.Printf("Setting --addr from PORT to %#v\n", val)
-		if err := pflag.Set("addr", val); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(2)
-		}
-	}
-
-	pflag.VisitAll(func(flag *pflag.Flag) {
-		if env, ok := envmap[flag.Name]; ok {
-			flag.Usage += fmt.Sprintf(" (env %s)", env)
-			if val, ok := os.LookupEnv(env); ok {
-				fmt.Printf("Setting --%s from %s to %#v\n", flag.Name, env, val)
-				if err := flag.Value.Set(val); err != nil {
-					fmt.Printf("Error: %v\n", err)
-					os.Exit(2)
+	o, fs, err := parseOptions(os.Args[1:], os.LookupEnv)
+	if err == pflag.ErrHelp {
+		fs.Usage()
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		os.Exit(2)
+	}
+
+	stdLogger.Configure(o.LogFormat == "json", o.logLevel())
+	for _, msg := range o.sources {
+		logf(levelInfo, "%s\n", msg)
+	}
+
+	if err := recordings.Configure(o.RecordDir, o.RecordRetention); err != nil {
+		logf(levelError, "%v.\n", err)
+		os.Exit(2)
+	}
+
+	h, err := newHandler(o)
+	if err != nil {
+		logf(levelError, "%v.\n", err)
+		os.Exit(2)
+	}
+
+	handler := new(swapHandler)
+	handler.Store(h)
+
+	var reloadMu sync.Mutex
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		logf(levelInfo, "Reloading configuration\n")
+		no, _, err := parseOptions(os.Args[1:], os.LookupEnv)
+		if err != nil {
+			return err
+		}
+
+		nh, err := newHandler(no)
+		if err != nil {
+			return err
+		}
+
+		if !reflect.DeepEqual(o.listenOptions, no.listenOptions) {
+			logf(levelWarn, "changes to listener, tls, acme, admin, and metrics-addr options require a restart to take effect.\n")
+		}
+
+		if err := recordings.Configure(no.RecordDir, no.RecordRetention); err != nil {
+			return err
+		}
+
+		stdLogger.Configure(no.LogFormat == "json", no.logLevel())
+		handler.Store(nh)
+		logf(levelInfo, "Reloaded configuration\n")
+		return nil
+	}
+
+	go func() {
+		for {
+			if n, err := recordings.Prune(); err != nil {
+				logf(levelError, "error deleting old recordings: %v.\n", err)
+			} else if n != 0 {
+				logf(levelInfo, "Deleted %d old recordings\n", n)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := reload(); err != nil {
+				logf(levelError, "error reloading configuration, keeping the old one: %v.\n", err)
+			}
+		}
+	}()
+
+	if o.AdminAddr != "" {
+		var ah http.Handler = adminHandler(reload, sessions)
+		if o.AdminHtpasswd != "" {
+			ht, err := loadHtpasswd(o.AdminHtpasswd)
+			if err != nil {
+				logf(levelError, "error loading admin htpasswd: %v.\n", err)
+				os.Exit(2)
+			}
+			ah = basicAuth("easy-novnc admin", ht)(ah)
+		}
+		go func() {
+			logf(levelInfo, "Listening for admin API on http://%s\n", o.AdminAddr)
+			if err := http.ListenAndServe(o.AdminAddr, ah); err != nil {
+				logf(levelError, "admin listener: %v.\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if o.RepeaterAddr != "" {
+		l, err := net.Listen("tcp", o.RepeaterAddr)
+		if err != nil {
+			logf(levelError, "repeater listener: %v.\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			logf(levelInfo, "Listening for repeater servers on %s\n", o.RepeaterAddr)
+			if err := repeaters.Serve(l); err != nil {
+				logf(levelError, "repeater listener: %v.\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if o.MetricsAddr != "" {
+		mr := mux.NewRouter()
+		mr.Use(serverHeader)
+		mr.Handle("/metrics", promhttp.Handler())
+		go func() {
+			logf(levelInfo, "Listening for metrics on http://%s/metrics\n", o.MetricsAddr)
+			if err := http.ListenAndServe(o.MetricsAddr, mr); err != nil {
+				logf(levelError, "metrics listener: %v.\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	addrs := make([]listenAddr, len(o.Addr))
+	hosts := make([]string, len(o.Addr))
+	for i, a := range o.Addr {
+		addrs[i], _ = parseListenAddr(a) // checked by validate
+		hosts[i] = addrs[i].Addr
+	}
+
+	var certs *certReloader
+	if o.TLSCert != "" {
+		if o.TLSSelfSigned {
+			if created, err := ensureSelfSignedCert(o.TLSCert, o.TLSKey, selfSignedHosts(hosts)); err != nil {
+				logf(levelError, "error generating self-signed certificate: %v.\n", err)
+				os.Exit(1)
+			} else if created {
+				logf(levelInfo, "Generated self-signed certificate %s\n", o.TLSCert)
+			}
+		}
+		if certs, err = newCertReloader(o.TLSCert, o.TLSKey); err != nil {
+			logf(levelError, "error loading tls certificate: %v.\n", err)
+			os.Exit(1)
+		}
+	}
+
+	srv := &http.Server{
+		Handler: handler,
+	}
+
+	// all listeners share the server (and therefore the handler), and are
+	// created before serving so errors are reported before anything starts
+	listeners := make([]net.Listener, len(addrs))
+	for i, la := range addrs {
+		if listeners[i], err = listen(la.Addr, o.unixSocketMode(), o.UnixSocketOwner); err != nil {
+			logf(levelError, "%v.\n", err)
+			os.Exit(1)
+		}
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	shutdownDone := make(chan struct{})
+	signal.Notify(shutdown, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-shutdown
+		logf(levelInfo, "Received %s, draining %d sessions (timeout: %s)\n", sig, sessions.Len(), o.DrainTimeout)
+
+		// srv.Shutdown doesn't wait for hijacked (i.e. websocket) connections,
+		// so those are drained separately at the same time
+		shutdownHTTP := make(chan struct{})
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), o.DrainTimeout)
+			defer cancel()
+			srv.Shutdown(ctx)
+			close(shutdownHTTP)
+		}()
+
+		for _, s := range sessions.Drain(o.DrainTimeout) {
+			stdLogger.Log(levelWarn, []logField{{"session", s.ID}}, "closed session after drain timeout: %s\n", s)
+		}
+
+		<-shutdownHTTP
+		close(shutdownDone)
+	}()
+
+	var tlsConfig *tls.Config
+	var tlsInfo string
+	if len(o.ACMEDomain) != 0 {
+		acmeCache := o.ACMECache
+		if acmeCache == "" {
+			acmeCache = defaultACMECache()
+		}
+		m := newACMEManager(o.ACMEDomain, o.ACMEEmail, o.ACMEDirectory, acmeCache)
+		tlsConfig = acmeTLSConfig(m)
+		tlsInfo = fmt.Sprintf(" (ACME: %s)", strings.Join(o.ACMEDomain, ", "))
+		if o.ACMEHTTPAddr != "" {
+			go func() {
+				logf(levelInfo, "Listening for ACME HTTP-01 challenges on http://%s\n", o.ACMEHTTPAddr)
+				if err := http.ListenAndServe(o.ACMEHTTPAddr, m.HTTPHandler(nil)); err != nil {
+					logf(levelError, "acme http listener: %v.\n", err)
+					os.Exit(1)
 				}
+			}()
+		}
+	} else if certs != nil {
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}
+	}
+
+	serveErr := make(chan error, len(listeners))
+	for i, la := range addrs {
+		l, cfg, info := listeners[i], tlsConfig, tlsInfo
+		if la.TLSCert != "" {
+			lc, err := newCertReloader(la.TLSCert, la.TLSKey)
+			if err != nil {
+				logf(levelError, "error loading tls certificate for %s: %v.\n", la.Addr, err)
+				os.Exit(1)
 			}
+			cfg, info = &tls.Config{GetCertificate: lc.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}, ""
+		} else if la.NoTLS {
+			cfg, info = nil, ""
 		}
-	})
+		if len(la.Allow) != 0 {
+			allow, _ := parseCIDRList(la.Allow) // checked by validate
+			l = allowListener{l, allow}
+			info += fmt.Sprintf(" (allow: %s)", strings.Join(la.Allow, ", "))
+		}
+		if cfg != nil {
+			logf(levelInfo, "Listening on %s%s\n", listenAddrString("https", l), info)
+			l = tls.NewListener(l, cfg)
+		} else {
+			logf(levelInfo, "Listening on %s%s\n", listenAddrString("http", l), info)
+		}
+		go func() {
+			serveErr <- srv.Serve(l)
+		}()
+	}
+	if !o.ArbitraryHosts && !o.ArbitraryPorts && o.Host == "localhost" && o.Port == 5900 && !o.BasicUI {
+		logf(levelInfo, "Run with --help for more options\n")
+	}
+	for range listeners {
+		if err := <-serveErr; err != nil && err != http.ErrServerClosed {
+			logf(levelError, "%v.\n", err)
+			os.Exit(1)
+		}
+	}
 
-	pflag.Parse()
+	<-shutdownDone
+	logf(levelInfo, "Shut down\n")
+}
 
-	if *arbitraryPorts && !*arbitraryHosts {
-		fmt.Printf("Error: arbitrary-ports requires arbitrary-hosts to be enabled.\n")
-		os.Exit(2)
+// newHandler creates the main http.Handler for the options. It is called again
+// with the new options when reloading.
+func newHandler(o *options) (http.Handler, error) {
+	trustedProxies, err := parseCIDRList(o.TrustedProxyCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing trusted proxy cidrs: %w", err)
 	}
 
-	cidrList, isWhitelist, err := parseCIDRBlackWhiteList(*cidrBlacklist, *cidrWhitelist)
+	cidrList, isWhitelist, err := parseCIDRBlackWhiteList(o.CIDRBlacklist, o.CIDRWhitelist)
 	if err != nil {
-		fmt.Printf("Error: error parsing cidr blacklist/whitelist: %v.\n", err)
-		os.Exit(2)
+		return nil, fmt.Errorf("error parsing cidr blacklist/whitelist: %w", err)
 	}
 
-	if len(cidrList) != 0 {
-		if err := checkCIDRBlackWhiteListHost(*host, cidrList, isWhitelist); err != nil {
-			fmt.Printf("Warning: default host does not parse cidr blacklist/whitelist: %v.\n", err)
+	if path, ok := unixSocketPath(o.Host); ok {
+		if err := checkUnixSocketWhitelist(path, o.UnixSocketWhitelist); err != nil {
+			logf(levelWarn, "default host does not pass unix socket whitelist: %v.\n", err)
+		}
+	} else if len(cidrList) != 0 {
+		if err := checkCIDRBlackWhiteListHost(o.Host, cidrList, isWhitelist); err != nil {
+			logf(levelWarn, "default host does not pass cidr blacklist/whitelist: %v.\n", err)
 		}
 	}
 
 	novncParamsMap := map[string]string{
 		"resize": "scale",
 	}
-	for _, p := range *novncParams {
+	for _, p := range o.NoVNCParams {
 		spl := strings.SplitN(p, "=", 2)
 		if len(spl) != 2 {
-			fmt.Printf("Error: error parsing noVNC params: must be in key=value format.\n")
-			os.Exit(2)
+			return nil, errors.New("error parsing noVNC params: must be in key=value format")
+		}
+		if err := checkNoVNCParam(spl[0]); err != nil {
+			return nil, fmt.Errorf("error parsing noVNC params: %w", err)
 		}
+		novncParamsMap[spl[0]] = spl[1]
+	}
 
-		// https://github.com/novnc/noVNC/blob/master/docs/EMBEDDING.md
-		switch spl[0] {
-		case "resize", "logging", "repeaterID", "reconnect_delay", "view_clip":
-			novncParamsMap[spl[0]] = spl[1]
-		case "encrypt", "reconnect", "path", "password", "view_only", "show_dot", "bell", "autoconnect":
-			fmt.Printf("Error: error parsing noVNC params: option %#v reserved for use by easy-novnc.\n", spl[0])
-			os.Exit(2)
-		default:
-			fmt.Printf("Error: error parsing noVNC params: unknown option %#v.\n", spl[0])
-			os.Exit(2)
+	var targets []*target
+	if o.Targets != "" {
+		if targets, err = loadTargets(o.Targets); err != nil {
+			return nil, fmt.Errorf("error loading targets: %w", err)
+		}
+		for _, t := range targets {
+			if t.Type == targetTypeExec {
+				continue
+			}
+			if path, ok := unixSocketPath(t.Address); ok {
+				if err := checkUnixSocketWhitelist(path, o.UnixSocketWhitelist); err != nil {
+					logf(levelWarn, "target %#v does not pass unix socket whitelist: %v.\n", t.Name, err)
+				}
+			} else if len(cidrList) != 0 {
+				if err := checkCIDRBlackWhiteListAddr(t.Address, cidrList, isWhitelist); err != nil {
+					logf(levelWarn, "target %#v does not pass cidr blacklist/whitelist: %v.\n", t.Name, err)
+				}
+			}
 		}
 	}
 
-	if *help {
-		pflag.Usage()
-		os.Exit(1)
+	var ht *htpasswd
+	if o.Htpasswd != "" {
+		if ht, err = loadHtpasswd(o.Htpasswd); err != nil {
+			return nil, fmt.Errorf("error loading htpasswd: %w", err)
+		}
 	}
 
 	r := mux.NewRouter()
 	r.Use(noCache)
 	r.Use(serverHeader)
 
-	vnc := vncHandler(*host, *port, *verbose, *arbitraryHosts, *arbitraryPorts, cidrList, isWhitelist)
+	pp := proxyPolicy{
+		ViewOnly:      o.ForceViewOnly,
+		ViewOnlyUsers: map[string]bool{},
+	}
+	for _, u := range o.ViewOnlyUsers {
+		pp.ViewOnlyUsers[u] = true
+	}
+
+	r.Handle("/vnc/t/{name:[a-zA-Z0-9_.-]+}", targetHandler(targetsByName(targets), pp, cidrList, isWhitelist, o.UnixSocketWhitelist))
+
+	r.Handle("/vnc/repeater/{id:[0-9]+}", repeaterHandler(repeaters, pp))
+
+	vnc := vncHandler(o.Host, o.Port, o.ArbitraryHosts, o.ArbitraryPorts, pp, cidrList, isWhitelist, o.UnixSocketWhitelist)
 	r.Handle("/vnc", vnc)
 	r.Handle("/vnc/{host:[a-zA-Z0-9_.-]+}", vnc)
 	r.Handle("/vnc/{host:[a-zA-Z0-9_.-]+}/{port:[0-9]+}", vnc)
 	r.Handle("/vnc/{host:"+ipv6Regexp+"}", vnc)
 	r.Handle("/vnc/{host:"+ipv6Regexp+"}/{port:[0-9]+}", vnc)
 
+	if o.Metrics && o.MetricsAddr == "" {
+		r.Handle("/metrics", promhttp.Handler())
+	}
+
 	r.NotFoundHandler = fs("noVNC-master", noVNC)
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		indexTMPL.Execute(w, map[string]interface{}{
-			"arbitraryHosts":  *arbitraryHosts,
-			"arbitraryPorts":  *arbitraryPorts,
-			"host":            *host,
-			"port":            *port,
-			"addr":            *addr,
-			"basicUI":         *basicUI,
-			"noURLPassword":   *noURLPassword,
-			"defaultViewOnly": *defaultViewOnly,
+			"arbitraryHosts":  o.ArbitraryHosts,
+			"arbitraryPorts":  o.ArbitraryPorts,
+			"host":            o.Host,
+			"port":            o.Port,
+			"addr":            o.Addr,
+			"basicUI":         o.BasicUI,
+			"noURLPassword":   o.NoURLPassword,
+			"defaultViewOnly": o.DefaultViewOnly || o.ForceViewOnly,
 			"params":          novncParamsMap,
+			"targets":         targetsInfo(targets),
 		})
 	})
 
-	fmt.Printf("Listening on http://%s\n", *addr)
-	if !*arbitraryHosts && !*arbitraryPorts && *host == "localhost" && *port == 5900 && !*basicUI {
-		fmt.Printf("Run with --help for more options\n")
+	// note: the auth middleware wraps the router itself rather than using
+	// r.Use so it also applies to the NotFoundHandler (the noVNC files)
+	var h http.Handler = r
+	if ht != nil {
+		h = basicAuth("easy-novnc", ht)(h)
 	}
-	if err := http.ListenAndServe(*addr, r); err != nil {
-		logf(true, "Error: %v.\n", err)
-		os.Exit(1)
+	if o.UserHeader != "" {
+		h = proxyAuth(o.UserHeader, trustedProxies, ht != nil)(h)
+	}
+	return h, nil
+}
+
+// swapHandler is a http.Handler which can be atomically replaced. Requests
+// which are already being handled (e.g. websocket connections) continue to use
+// the old handler.
+type swapHandler struct {
+	v atomic.Value
+}
+
+// Store replaces the handler.
+func (s *swapHandler) Store(h http.Handler) {
+	s.v.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.v.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+// checkNoVNCParam checks whether a noVNC param is allowed to be set by the
+// user.
+func checkNoVNCParam(key string) error {
+	// https://github.com/novnc/noVNC/blob/master/docs/EMBEDDING.md
+	switch key {
+	case "resize", "logging", "repeaterID", "reconnect_delay", "view_clip":
+		return nil
+	case "encrypt", "reconnect", "path", "password", "view_only", "show_dot", "bell", "autoconnect":
+		return fmt.Errorf("option %#v reserved for use by easy-novnc", key)
+	default:
+		return fmt.Errorf("unknown option %#v", key)
 	}
 }
 
 // vncHandler creates a handler for vnc connections. If host and port are set in
-// the url vars, they will be used if allowed.
-func vncHandler(defhost string, defport uint16, verbose, allowHosts, allowPorts bool, cidrList []*net.IPNet, isWhitelist bool) http.Handler {
+// the url vars, they will be used if allowed. If defhost is a unix socket
+// address, defport is ignored.
+func vncHandler(defhost string, defport uint16, allowHosts, allowPorts bool, pp proxyPolicy, cidrList []*net.IPNet, isWhitelist bool, unixWhitelist []string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var host, port string
 
+		r = withSessionID(r, newSessionID())
+
 		if host = mux.Vars(r)["host"]; host == "" {
 			host = defhost
 		} else if !allowHosts {
-			logf(verbose, "connect %s disabled\n", host)
+			metricRejected.WithLabelValues(rejectArbitraryHosts).Inc()
+			logr(r, levelDebug, "connect %s disabled for %s\n", host, requestWho(r))
 			http.Error(w, "--arbitrary-hosts disabled", http.StatusUnauthorized)
 			return
 		}
@@ -184,35 +462,158 @@ func vncHandler(defhost string, defport uint16, verbose, allowHosts, allowPorts
 		if port = mux.Vars(r)["port"]; port == "" {
 			port = fmt.Sprint(defport)
 		} else if !allowPorts {
-			logf(verbose, "connect %s:%s disabled\n", host, port)
+			metricRejected.WithLabelValues(rejectArbitraryPorts).Inc()
+			logr(r, levelDebug, "connect %s:%s disabled for %s\n", host, port, requestWho(r))
 			http.Error(w, "--arbitrary-ports disabled", http.StatusUnauthorized)
 			return
 		}
 
-		if len(cidrList) != 0 {
-			if err := checkCIDRBlackWhiteListHost(host, cidrList, isWhitelist); err != nil {
-				logf(verbose, "connect %s:%s not allowed: %v\n", host, port, err)
-				http.Error(w, fmt.Sprintf("connect %s:%s not allowed: %v\n", host, port, err), http.StatusUnauthorized)
-				return
-			}
-		}
-
 		addr := host + ":" + port
 		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
 			addr = "[" + host + "]:" + port
+		} else if _, ok := unixSocketPath(host); ok {
+			addr = host
+		}
+
+		label := targetLabelArbitrary
+		if host == defhost && port == fmt.Sprint(defport) {
+			label = targetLabelDefault
+		}
+
+		vncConnect(w, withTarget(r, label), addr, websockify(addr, addrDialer(addr), pp.proxy(r, nil)), cidrList, isWhitelist, unixWhitelist)
+	})
+}
+
+// targetHandler creates a handler for vnc connections to named targets. The
+// target name is taken from the url vars.
+func targetHandler(targets map[string]*target, pp proxyPolicy, cidrList []*net.IPNet, isWhitelist bool, unixWhitelist []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		r = withSessionID(r, newSessionID())
+
+		t, ok := targets[name]
+		if !ok {
+			metricRejected.WithLabelValues(rejectUnknownTarget).Inc()
+			logr(r, levelDebug, "connect to unknown target %#v for %s\n", name, requestWho(r))
+			http.Error(w, fmt.Sprintf("unknown target %#v", name), http.StatusNotFound)
+			return
+		}
+
+		p := pp.proxy(r, t)
+		password, err := t.vncPassword()
+		if err != nil {
+			logr(r, levelError, "error getting password for target %#v: %v.\n", t.Name, err)
+			http.Error(w, fmt.Sprintf("error getting password for target %#v", t.Name), http.StatusInternalServerError)
+			return
+		}
+
+		logr(r, levelDebug, "connect target %#v for %s\n", t.Name, requestWho(r))
+		p.Password = password
+
+		cidr := cidrList
+		if t.Type == targetTypeExec {
+			cidr = nil // local process
+		}
+		if t.Broadcast {
+			vncConnect(w, withTarget(r, t.Name), t.addr(), broadcastHandler(t, p), cidr, isWhitelist, unixWhitelist)
+		} else {
+			vncConnect(w, withTarget(r, t.Name), t.addr(), websockify(t.addr(), t.dialer(), p), cidr, isWhitelist, unixWhitelist)
 		}
+	})
+}
+
+// repeaterHandler creates a handler for vnc connections to servers waiting on
+// the repeater. The repeater ID is taken from the url vars.
+func repeaterHandler(rr *repeaterRegistry, pp proxyPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		r = withSessionID(r, newSessionID())
 
-		logf(verbose, "connect %s\n", addr)
-		w.Header().Set("X-Target-Addr", addr)
-		websockify(addr, []byte("RFB")).ServeHTTP(w, r)
+		logr(r, levelDebug, "connect repeater ID %s for %s\n", id, requestWho(r))
+
+		addr := "repeater:" + id
+		vncConnect(w, withTarget(r, targetLabelRepeater), addr, websockify(addr, rr.dialer(id), pp.proxy(r, nil)), nil, false, nil)
 	})
 }
 
-// logf calls fmt.Printf with the date if the condition is true.
-func logf(cond bool, format string, a ...interface{}) {
-	if cond {
-		fmt.Printf("%s: %s", time.Now().Format("Jan 02 15:04:05"), fmt.Sprintf(format, a...))
+// proxyPolicy contains the server-side restrictions on proxied connections.
+type proxyPolicy struct {
+	ViewOnly      bool
+	ViewOnlyUsers map[string]bool
+}
+
+// proxy returns the rfbProxy for a connection to t (nil for hosts which aren't
+// named targets) by the user who made r.
+func (pp proxyPolicy) proxy(r *http.Request, t *target) rfbProxy {
+	p := rfbProxy{
+		Policies: rfbPolicies,
+		ViewOnly: pp.ViewOnly || pp.ViewOnlyUsers[requestUser(r)],
+	}
+	if t != nil {
+		if t.ForceViewOnly {
+			p.ViewOnly = true
+		}
+		p.NoClipboardToServer = t.Clipboard == clipboardOutbound || t.Clipboard == clipboardNone
+		p.NoClipboardToClient = t.Clipboard == clipboardInbound || t.Clipboard == clipboardNone
+		p.ClipboardMaxSize = t.ClipboardMaxSize
+		if t.ClipboardAudit != "" {
+			p.ClipboardAudit = clipboardAudit(r, t.ClipboardAudit == clipboardAuditContent)
+		}
+		p.ForceShared = t.Shared == sharedForceTrue
+		p.ForceExclusive = t.Shared == sharedForceFalse
+	}
+	return p
+}
+
+// clipboardAudit returns a function which logs clipboard transfers for r,
+// including either the text or its SHA-256 hash.
+func clipboardAudit(r *http.Request, content bool) func(toServer bool, text []byte, allowed bool) {
+	return func(toServer bool, text []byte, allowed bool) {
+		dir, action := "to client", "allowed"
+		if toServer {
+			dir = "to server"
+		}
+		if !allowed {
+			action = "dropped"
+		}
+		if content {
+			logr(r, levelInfo, "clipboard %s %s for %s (%d bytes): %q\n", dir, action, requestWho(r), len(text), text)
+		} else {
+			logr(r, levelInfo, "clipboard %s %s for %s (%d bytes): sha256 %x\n", dir, action, requestWho(r), len(text), sha256.Sum256(text))
+		}
+	}
+}
+
+// vncConnect checks addr against the cidr list (or the unix socket whitelist for
+// unix socket addresses) and passes the websocket connection to h.
+func vncConnect(w http.ResponseWriter, r *http.Request, addr string, h http.Handler, cidrList []*net.IPNet, isWhitelist bool, unixWhitelist []string) {
+	if sessions.Draining() {
+		metricRejected.WithLabelValues(rejectShuttingDown).Inc()
+		http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if path, ok := unixSocketPath(addr); ok {
+		if err := checkUnixSocketWhitelist(path, unixWhitelist); err != nil {
+			metricRejected.WithLabelValues(rejectUnixSocket).Inc()
+			logr(r, levelDebug, "connect %s not allowed for %s: %v\n", addr, requestWho(r), err)
+			http.Error(w, fmt.Sprintf("connect %s not allowed: %v\n", addr, err), http.StatusUnauthorized)
+			return
+		}
+	} else if len(cidrList) != 0 {
+		if err := checkCIDRBlackWhiteListAddr(addr, cidrList, isWhitelist); err != nil {
+			metricRejected.WithLabelValues(rejectCIDR).Inc()
+			logr(r, levelDebug, "connect %s not allowed for %s: %v\n", addr, requestWho(r), err)
+			http.Error(w, fmt.Sprintf("connect %s not allowed: %v\n", addr, err), http.StatusUnauthorized)
+			return
+		}
 	}
+
+	logr(r, levelInfo, "connect %s for %s\n", addr, requestWho(r))
+	w.Header().Set("X-Target-Addr", addr)
+	h.ServeHTTP(w, r)
 }
 
 // noCache disables caching on a http.Handler.
@@ -248,12 +649,30 @@ func addPrefix(prefix string, h http.Handler) http.Handler {
 	})
 }
 
-// websockify returns an http.Handler which proxies websocket requests to a tcp
-// address and checks magic bytes.
-func websockify(to string, magic []byte) http.Handler {
+// rfbPolicies are the policies enforced on the handshake of every proxied
+// connection.
+var rfbPolicies = []rfbPolicy{
+	rfbMagicPolicy([]byte("RFB")),
+	rfbVersionPolicy,
+}
+
+// dialFunc connects to a VNC server for a request. If the error is a
+// *rfbFailure, the reason is shown to the client.
+type dialFunc func(r *http.Request) (net.Conn, error)
+
+// tcpDialer returns a dialFunc which connects to a tcp address.
+func tcpDialer(addr string) dialFunc {
+	return func(r *http.Request) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+}
+
+// websockify returns an http.Handler which proxies websocket requests to the
+// server at to (connected to with dial), relaying the RFB handshake with p.
+func websockify(to string, dial dialFunc, p rfbProxy) http.Handler {
 	return websocket.Server{
 		Handshake: wsProxyHandshake,
-		Handler:   wsProxyHandler(to, magic),
+		Handler:   wsProxyHandler(to, dial, p),
 	}
 }
 
@@ -267,43 +686,195 @@ func wsProxyHandshake(config *websocket.Config, r *http.Request) error {
 	return nil
 }
 
-// wsProxyHandler is a websocket.Handler which proxies to a tcp address with a
-// magic byte check.
-func wsProxyHandler(to string, magic []byte) websocket.Handler {
+// wsProxyHandler is a websocket.Handler which proxies to the server at to
+// (connected to with dial), relaying the RFB handshake with p.
+func wsProxyHandler(to string, dial dialFunc, p rfbProxy) websocket.Handler {
 	return func(ws *websocket.Conn) {
-		conn, err := net.Dial("tcp", to)
+		r := ws.Request()
+		if requestSessionID(r) == "" {
+			r = withSessionID(r, newSessionID())
+		}
+
+		label := requestTarget(r)
+		metricUpgrades.WithLabelValues(label).Inc()
+
+		conn, err := dial(r)
 		if err != nil {
+			metricRejected.WithLabelValues(rejectDial).Inc()
+			logr(r, levelWarn, "error connecting to %s for %s: %v\n", to, requestWho(r), err)
+			if f, ok := err.(*rfbFailure); ok {
+				ws.PayloadType = websocket.BinaryFrame
+				rfbRefuse(rfbConn{bufio.NewReader(ws), ws}, f.Reason)
+			}
 			ws.Close()
 			return
 		}
 
+		s := &session{
+			ID:     requestSessionID(r),
+			Client: r.RemoteAddr,
+			User:   requestUser(r),
+			Target: to,
+			Start:  time.Now(),
+			close: func() {
+				conn.Close()
+				ws.Close()
+			},
+		}
+		if err := sessions.Add(s); err != nil {
+			metricRejected.WithLabelValues(rejectShuttingDown).Inc()
+			conn.Close()
+			ws.Close()
+			return
+		}
+		defer sessions.Remove(s)
+
+		metricActiveSessions.WithLabelValues(label).Inc()
+		defer metricActiveSessions.WithLabelValues(label).Dec()
+		defer func() {
+			metricSessionDuration.WithLabelValues(label).Observe(time.Since(s.Start).Seconds())
+		}()
+
 		ws.PayloadType = websocket.BinaryFrame
 
-		m := newMagicCheck(conn, magic)
+		toServer := metricBytes.WithLabelValues(label, "to_server")
+		toClient := metricBytes.WithLabelValues(label, "to_client")
+
+		rec, err := recordings.Start(s)
+		if err != nil {
+			logr(r, levelError, "error starting recording for %s: %v.\n", requestWho(r), err)
+		} else if rec != nil {
+			logr(r, levelInfo, "recording %s to %s\n", requestWho(r), rec.Filename())
+		}
+
+		// the recording is of what the client sees, which differs from what
+		// is sent to the server if the handshake was modified
+		var cr io.Reader = ws
+		if rec != nil {
+			cr = teeReader{ws, func(p []byte) {
+				rec.Record(recToServer, p)
+			}}
+		}
+
+		c := rfbConn{bufio.NewReader(cr), teeWriter{ws, func(p []byte) {
+			s.CountToClient(len(p))
+			toClient.Add(float64(len(p)))
+			if rec != nil {
+				rec.Record(recToClient, p)
+			}
+		}}}
+		sv := rfbConn{bufio.NewReader(conn), teeWriter{conn, func(p []byte) {
+			s.CountToServer(len(p))
+			toServer.Add(float64(len(p)))
+		}}}
+
+		if h, err := p.Handshake(c, sv); err != nil {
+			if perr, ok := err.(*rfbPolicyError); ok {
+				metricRejected.WithLabelValues(perr.Reason).Inc()
+				logr(r, levelWarn, "rejected connection to %s for %s: %v\n", to, requestWho(r), err)
+			} else {
+				logr(r, levelInfo, "handshake with %s failed for %s: %v (%s)\n", to, requestWho(r), err, h)
+			}
+		} else {
+			logr(r, levelInfo, "handshake with %s for %s: %s\n", to, requestWho(r), h)
+			if p.ViewOnly {
+				logr(r, levelInfo, "enforcing view-only for %s\n", requestWho(r))
+			}
+			if p.filtersServer() {
+				logr(r, levelDebug, "filtering clipboard for %s\n", requestWho(r))
+			}
+			if p.ForceShared || p.ForceExclusive {
+				logr(r, levelDebug, "forced shared flag to %t for %s\n", h.Shared, requestWho(r))
+			}
 
-		done := make(chan error)
-		go copyCh(conn, ws, done)
-		go copyCh(ws, m, done)
+			st := newRFBState(h)
+			done := make(chan error)
+			if p.filtersClient() {
+				go func() {
+					done <- p.CopyClient(sv, c.Reader, st)
+				}()
+			} else {
+				go copyCh(sv, c, nil, done)
+			}
+			if p.filtersServer() {
+				go func() {
+					done <- p.CopyServer(c, sv.Reader, st)
+				}()
+			} else {
+				go copyCh(c, sv, nil, done)
+			}
 
-		err = <-done
-		if m.Failed() {
-			logf(true, "attempt to connect to non-VNC port (%s, %#v)\n", to, string(m.Magic()))
-		} else if err != nil {
-			logf(true, "%v\n", err)
+			if err := <-done; err != nil {
+				logr(r, levelDebug, "%s: %v\n", requestWho(r), err)
+			}
+			conn.Close()
+			ws.Close()
+			<-done
 		}
+		logr(r, levelInfo, "disconnect %s for %s after %s\n", to, requestWho(r), time.Since(s.Start).Round(time.Second))
 
 		conn.Close()
 		ws.Close()
-		<-done
+
+		if rec != nil {
+			if err := rec.Close(); err != nil {
+				logr(r, levelError, "recording %s is incomplete: %v.\n", rec.Filename(), err)
+			}
+		}
 	}
 }
 
-// copyCh is like io.Copy, but it writes to a channel when finished.
-func copyCh(dst io.Writer, src io.Reader, done chan error) {
+// copyCh is like io.Copy, but it writes to a channel when finished. If tee is
+// not nil, it is called with the data after each write (it must not modify or
+// retain it).
+func copyCh(dst io.Writer, src io.Reader, tee func(p []byte), done chan error) {
+	if tee != nil {
+		dst = teeWriter{dst, tee}
+	}
 	_, err := io.Copy(dst, src)
 	done <- err
 }
 
+// teeWriter wraps an io.Writer and calls a function with the data which was
+// written.
+type teeWriter struct {
+	w   io.Writer
+	tee func(p []byte)
+}
+
+func (t teeWriter) Write(buf []byte) (int, error) {
+	n, err := t.w.Write(buf)
+	if n > 0 {
+		t.tee(buf[:n])
+	}
+	return n, err
+}
+
+// teeReader wraps an io.Reader and calls a function with the data which was
+// read.
+type teeReader struct {
+	r   io.Reader
+	tee func(p []byte)
+}
+
+func (t teeReader) Read(buf []byte) (int, error) {
+	n, err := t.r.Read(buf)
+	if n > 0 {
+		t.tee(buf[:n])
+	}
+	return n, err
+}
+
+// checkCIDRBlackWhiteListAddr checks the host of the provided host:port against a
+// blacklist/whitelist.
+func checkCIDRBlackWhiteListAddr(addr string, cidrList []*net.IPNet, isWhitelist bool) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return checkCIDRBlackWhiteListHost(host, cidrList, isWhitelist)
+}
+
 // checkCIDRBlackWhiteListHost checks the provided host/ip against a blacklist/whitelist.
 func checkCIDRBlackWhiteListHost(host string, cidrList []*net.IPNet, isWhitelist bool) error {
 	ips, err := net.LookupIP(host)
@@ -363,47 +934,3 @@ func parseCIDRList(cidrs []string) ([]*net.IPNet, error) {
 	}
 	return res, nil
 }
-
-// magicCheck implements an efficient wrapper around an io.Reader which checks
-// for magic bytes at the beginning, and will return a sticky io.EOF and stop
-// reading from the original reader as soon as a mismatch starts.
-type magicCheck struct {
-	rdr io.Reader
-	exp []byte
-	len int
-	rem int
-	act []byte
-	fld bool
-}
-
-func newMagicCheck(r io.Reader, magic []byte) *magicCheck {
-	return &magicCheck{r, magic, len(magic), len(magic), make([]byte, len(magic)), false}
-}
-
-// Failed returns true if the magic check has failed (note that it returns false
-// if the source io.Reader reached io.EOF before the check was complete).
-func (m *magicCheck) Failed() bool {
-	return m.fld
-}
-
-// Magic returns the magic which was read so far.
-func (m *magicCheck) Magic() []byte {
-	return m.act
-}
-
-func (m *magicCheck) Read(buf []byte) (n int, err error) {
-	if m.fld {
-		return 0, io.EOF
-	}
-	n, err = m.rdr.Read(buf)
-	if err == nil && n > 0 && m.rem > 0 {
-		m.rem -= copy(m.act[m.len-m.rem:], buf[:n])
-		for i := 0; i < m.len-m.rem; i++ {
-			if m.act[i] != m.exp[i] {
-				m.fld = true
-				return 0, io.EOF
-			}
-		}
-	}
-	return n, err
-}
@@ -36,7 +36,7 @@ func TestVNCHandler(t *testing.T) {
 						panic(err)
 					}
 				}()
-				vnc := vncHandler(defhost, defport, false, allowHosts, allowPorts, cidrList, isWhitelist)
+				vnc := vncHandler(defhost, defport, allowHosts, allowPorts, proxyPolicy{}, cidrList, isWhitelist, []string{"/run/vnc/*.sock"})
 				m := mux.NewRouter()
 				m.Handle("/vnc", vnc)
 				m.Handle("/vnc/{host:[a-zA-Z0-9_.-]+}", vnc)
@@ -67,6 +67,12 @@ func TestVNCHandler(t *testing.T) {
 	t.Run("CustomHost", testCase("http://example.com/vnc/test", 101, "test:1234", "example.com", 1234, true, false, nil, false))
 	t.Run("CustomHostPort", testCase("http://example.com/vnc/test/3456", 101, "test:3456", "example.com", 1234, true, true, nil, false))
 
+	t.Run("UnixAllow", testCase("http://example.com/vnc", 101, "unix:/run/vnc/vm1.sock", "unix:/run/vnc/vm1.sock", 5900, false, false, nil, false))
+	t.Run("UnixBlock", testCase("http://example.com/vnc", 401, "", "unix:/tmp/vm1.sock", 5900, false, false, nil, false))
+	t.Run("UnixBlockTraversal", testCase("http://example.com/vnc", 401, "", "unix:/run/vnc/../vm1.sock", 5900, false, false, nil, false))
+	t.Run("UnixIgnoresCIDR", testCase("http://example.com/vnc", 101, "unix:/run/vnc/vm1.sock", "unix:/run/vnc/vm1.sock", 5900, false, false, mustParseCIDRList("192.168.0.0/24"), true))
+	t.Run("UnixCustomHost", testCase("http://example.com/vnc/test", 101, "test:5900", "unix:/run/vnc/vm1.sock", 5900, true, false, nil, false))
+
 	t.Run("CIDRWhitelistAllowIP", testCase("http://example.com/vnc/10.0.0.1", 101, "10.0.0.1:5900", "localhost", 5900, true, true, mustParseCIDRList("192.168.0.0/24,10.0.0.0/24"), true))
 	t.Run("CIDRWhitelistBlockIP", testCase("http://example.com/vnc/127.0.0.1", 401, "", "localhost", 5900, true, true, mustParseCIDRList("192.168.0.0/24,10.0.0.0/24"), true))
 	t.Run("CIDRBlacklistBlockIP", testCase("http://example.com/vnc/10.0.0.1", 401, "", "localhost", 5900, true, true, mustParseCIDRList("192.168.0.0/24,10.0.0.0/24"), false))
@@ -94,7 +100,7 @@ func TestWebsockify(t *testing.T) {
 			panic(err)
 		}
 	}()
-	websockify("google.com:80", []byte(nil)).ServeHTTP(nilResponseWriter{}, httptest.NewRequest("GET", "/", nil))
+	websockify("google.com:80", tcpDialer("google.com:80"), rfbProxy{}).ServeHTTP(nilResponseWriter{}, httptest.NewRequest("GET", "/", nil))
 	// TODO: proper testing
 }
 
@@ -111,19 +117,24 @@ func (nilResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return nil, nil, errors.New("not implemented")
 }
 
-func TestLogf(t *testing.T) {
-	for _, c := range []struct {
-		Cond   bool
-		Format string
-		Args   []interface{}
-		Out    string
-	}{
-		{false, "test\n", nil, ""},
-		{true, "test\n", nil, "test"},
-		{true, "test %s\n", []interface{}{"test"}, "test test"},
-	} {
-		logf(c.Cond, c.Format, c.Args...)
-		// TODO: figure out a way to test c.Out
+func TestSwapHandler(t *testing.T) {
+	var s swapHandler
+	s.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected first handler to be used")
+	}
+
+	s.Store(http.NotFoundHandler())
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected second handler to be used")
 	}
 }
 
@@ -210,6 +221,59 @@ func TestAddPrefix(t *testing.T) {
 	}
 }
 
+func TestProxyPolicy(t *testing.T) {
+	pp := proxyPolicy{ViewOnlyUsers: map[string]bool{"viewer": true}}
+	r := httptest.NewRequest("GET", "/vnc", nil)
+	for _, c := range []struct {
+		User     string
+		Target   *target
+		ViewOnly bool
+	}{
+		{"", nil, false},
+		{"user", nil, false},
+		{"viewer", nil, true},
+		{"user", &target{}, false},
+		{"user", &target{ForceViewOnly: true}, true},
+	} {
+		if p := pp.proxy(withUser(r, c.User), c.Target); p.ViewOnly != c.ViewOnly {
+			t.Errorf("%#v %+v: expected view-only %t", c.User, c.Target, c.ViewOnly)
+		}
+	}
+	if p := (proxyPolicy{ViewOnly: true}).proxy(r, nil); !p.ViewOnly {
+		t.Errorf("expected view-only to be forced")
+	}
+
+	for _, c := range []struct {
+		Clipboard          string
+		ToServer, ToClient bool
+	}{
+		{"", true, true},
+		{clipboardBoth, true, true},
+		{clipboardInbound, true, false},
+		{clipboardOutbound, false, true},
+		{clipboardNone, false, false},
+	} {
+		p := pp.proxy(r, &target{Clipboard: c.Clipboard, ClipboardMaxSize: 10, ClipboardAudit: clipboardAuditHash})
+		if p.NoClipboardToServer == c.ToServer || p.NoClipboardToClient == c.ToClient || p.ClipboardMaxSize != 10 || p.ClipboardAudit == nil {
+			t.Errorf("%#v: incorrect clipboard policy %+v", c.Clipboard, p)
+		}
+	}
+
+	for _, c := range []struct {
+		Mode              string
+		Shared, Exclusive bool
+	}{
+		{"", false, false},
+		{sharedPassthrough, false, false},
+		{sharedForceTrue, true, false},
+		{sharedForceFalse, false, true},
+	} {
+		if p := pp.proxy(r, &target{Shared: c.Mode}); p.ForceShared != c.Shared || p.ForceExclusive != c.Exclusive {
+			t.Errorf("%#v: incorrect shared policy %+v", c.Mode, p)
+		}
+	}
+}
+
 func TestCopyCh(t *testing.T) {
 	testCase := func(r *testReader, shouldError bool) func(*testing.T) {
 		return func(t *testing.T) {
@@ -217,7 +281,7 @@ func TestCopyCh(t *testing.T) {
 			src := r
 			ch := make(chan error)
 
-			go copyCh(dst, src, ch)
+			go copyCh(dst, src, nil, ch)
 			n := time.Now()
 
 			select {
@@ -326,55 +390,6 @@ func TestIPv6Regexp(t *testing.T) {
 	}
 }
 
-func TestMagicCheck(t *testing.T) {
-	for _, tc := range []struct {
-		Name string
-
-		Magic []byte
-		Input []byte
-
-		EOFAt  int
-		Failed bool
-	}{
-		{"Good_BothEmpty", []byte(""), []byte(""), 0, false},
-		{"Good_EmptyMagicWithInput", []byte(""), []byte(" "), 1, false},
-		{"Good_EmptyInputWithMagic", []byte("RFB"), []byte(""), 0, false},
-		{"Good_ExactMatch", []byte("RFB"), []byte("RFB"), 3, false},
-		{"Good_ExactMatchWithExtra", []byte("RFB"), []byte("RFB 005.000"), 11, false},
-		{"Bad_NoMatch", []byte("RFB"), []byte("..."), 0, true},
-		{"Bad_PartialMatch", []byte("RFB"), []byte("R.."), 1, true},
-	} {
-		t.Run(tc.Name, func(t *testing.T) {
-			m := newMagicCheck(bytes.NewReader(tc.Input), tc.Magic)
-			var buf []byte
-
-			rbuf := make([]byte, 1)
-			for {
-				n, err := m.Read(rbuf)
-				if err == io.EOF {
-					if n, err := m.Read(rbuf); err != io.EOF || n != 0 {
-						t.Errorf("expected io.EOF to stick with no bytes read")
-					}
-					if tc.EOFAt < 0 {
-						t.Errorf("unexpected eof after %d bytes", len(buf))
-					} else if len(buf) != tc.EOFAt {
-						t.Errorf("unexpected eof after %d bytes, expected %d bytes (buf: %s)", len(buf), tc.EOFAt, string(buf))
-					} else if m.Failed() != tc.Failed {
-						t.Errorf("expected failed=%t, got %t", tc.Failed, m.Failed())
-					} else if !m.Failed() && len(tc.Input) >= len(tc.Magic) && !bytes.Equal(m.Magic(), tc.Magic) {
-						t.Errorf("shouldn't have passed the magic check: %s != %s", string(m.Magic()), string(tc.Magic))
-					}
-					break
-				} else if err != nil {
-					panic(err)
-				} else if n > 0 {
-					buf = append(buf, rbuf[:n]...)
-				}
-			}
-		})
-	}
-}
-
 // testReader is a custom io.Reader which throttles the reads and can return
 // an error at a specific point.
 type testReader struct {
@@ -0,0 +1,225 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errDraining is returned when attempting to add a session while draining.
+var errDraining = errors.New("server is shutting down")
+
+// sessions contains the active proxied sessions.
+var sessions = newSessionRegistry()
+
+// session is an active proxied connection.
+type session struct {
+	bytesToServer int64 // atomic, must be 64-bit aligned
+	bytesToClient int64 // atomic, must be 64-bit aligned
+
+	ID     string
+	Client string
+	User   string
+	Target string
+	Start  time.Time
+
+	close func()
+}
+
+// sessionInfo is the JSON representation of a session.
+type sessionInfo struct {
+	ID            string    `json:"id"`
+	Client        string    `json:"client"`
+	User          string    `json:"user,omitempty"`
+	Target        string    `json:"target"`
+	Start         time.Time `json:"start"`
+	BytesToServer int64     `json:"bytes_to_server"`
+	BytesToClient int64     `json:"bytes_to_client"`
+}
+
+// Info returns information about the session.
+func (s *session) Info() sessionInfo {
+	return sessionInfo{
+		ID:            s.ID,
+		Client:        s.Client,
+		User:          s.User,
+		Target:        s.Target,
+		Start:         s.Start,
+		BytesToServer: atomic.LoadInt64(&s.bytesToServer),
+		BytesToClient: atomic.LoadInt64(&s.bytesToClient),
+	}
+}
+
+// CountToServer adds to the number of bytes sent to the server.
+func (s *session) CountToServer(n int) {
+	atomic.AddInt64(&s.bytesToServer, int64(n))
+}
+
+// CountToClient adds to the number of bytes sent to the client.
+func (s *session) CountToClient(n int) {
+	atomic.AddInt64(&s.bytesToClient, int64(n))
+}
+
+// String returns a description of the session for log messages.
+func (s *session) String() string {
+	client := s.Client
+	if s.User != "" {
+		client = fmt.Sprintf("%s (%s)", s.Client, s.User)
+	}
+	return fmt.Sprintf("%s => %s (%s)", client, s.Target, time.Since(s.Start).Round(time.Second))
+}
+
+// Close forcefully closes the session.
+func (s *session) Close() {
+	if s.close != nil {
+		s.close()
+	}
+}
+
+// newSessionID generates a random ID for correlating the log messages of a
+// session.
+func newSessionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// withSessionID returns a shallow copy of the request with the session ID set.
+func withSessionID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeySession, id))
+}
+
+// requestSessionID returns the session ID for a request, if any.
+func requestSessionID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxKeySession).(string)
+	return id
+}
+
+// sessionRegistry keeps track of active sessions so they can be drained.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// newSessionRegistry creates a new sessionRegistry.
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: map[*session]struct{}{},
+	}
+}
+
+// Add adds a session. If the registry is draining, errDraining is returned.
+func (r *sessionRegistry) Add(s *session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return errDraining
+	}
+	r.sessions[s] = struct{}{}
+	r.wg.Add(1)
+	return nil
+}
+
+// Remove removes a session.
+func (r *sessionRegistry) Remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[s]; ok {
+		delete(r.sessions, s)
+		r.wg.Done()
+	}
+}
+
+// Get returns the session with the specified ID, or nil if it doesn't exist.
+func (r *sessionRegistry) Get(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range r.sessions {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// List returns the active sessions, oldest first.
+func (r *sessionRegistry) List() []*session {
+	r.mu.Lock()
+	ss := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		ss = append(ss, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Start.Before(ss[j].Start)
+	})
+	return ss
+}
+
+// Draining returns true if the registry is draining.
+func (r *sessionRegistry) Draining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// Len returns the number of active sessions.
+func (r *sessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Drain stops accepting new sessions, then waits up to timeout for the active
+// ones to finish. Any remaining sessions are forcefully closed and returned.
+func (r *sessionRegistry) Drain(timeout time.Duration) []*session {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+
+	if r.wait(timeout) {
+		return nil
+	}
+
+	r.mu.Lock()
+	cut := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		cut = append(cut, s)
+	}
+	r.mu.Unlock()
+
+	for _, s := range cut {
+		s.Close()
+	}
+	r.wait(time.Second * 5)
+	return cut
+}
+
+// wait waits for all sessions to be removed, returning false on timeout.
+func (r *sessionRegistry) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	t.Run("Finished", func(t *testing.T) {
+		r := newSessionRegistry()
+		s := &session{Client: "127.0.0.1:1234", Target: "localhost:5900", Start: time.Now(), close: func() {
+			t.Errorf("expected session not to be closed")
+		}}
+		if err := r.Add(s); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := r.Len(); n != 1 {
+			t.Errorf("expected 1 session, got %d", n)
+		}
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			r.Remove(s)
+		}()
+		if cut := r.Drain(time.Second * 5); len(cut) != 0 {
+			t.Errorf("expected no sessions to be cut, got %v", cut)
+		}
+		if n := r.Len(); n != 0 {
+			t.Errorf("expected 0 sessions, got %d", n)
+		}
+	})
+
+	t.Run("Cut", func(t *testing.T) {
+		r := newSessionRegistry()
+		var s *session
+		s = &session{Client: "127.0.0.1:1234", User: "user", Target: "localhost:5900", Start: time.Now(), close: func() {
+			go r.Remove(s)
+		}}
+		if err := r.Add(s); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cut := r.Drain(time.Millisecond * 50); len(cut) != 1 || cut[0] != s {
+			t.Errorf("expected session to be cut, got %v", cut)
+		}
+		if n := r.Len(); n != 0 {
+			t.Errorf("expected 0 sessions, got %d", n)
+		}
+	})
+
+	t.Run("Draining", func(t *testing.T) {
+		r := newSessionRegistry()
+		if r.Draining() {
+			t.Errorf("expected registry not to be draining")
+		}
+		r.Drain(time.Second)
+		if !r.Draining() {
+			t.Errorf("expected registry to be draining")
+		}
+		if err := r.Add(&session{}); err != errDraining {
+			t.Errorf("expected errDraining, got %v", err)
+		}
+		r.Remove(&session{}) // should not panic
+	})
+
+	t.Run("String", func(t *testing.T) {
+		s := &session{Client: "127.0.0.1:1234", User: "user", Target: "localhost:5900", Start: time.Now()}
+		if str, exp := s.String(), "127.0.0.1:1234 (user) => localhost:5900 (0s)"; str != exp {
+			t.Errorf("expected %#v, got %#v", exp, str)
+		}
+	})
+}
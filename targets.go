@@ -0,0 +1,334 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// targetNameRegexp matches valid target names.
+var targetNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Clipboard transfer modes for targets, where inbound is from the browser to
+// the target.
+const (
+	clipboardBoth     = "both"
+	clipboardInbound  = "inbound"
+	clipboardOutbound = "outbound"
+	clipboardNone     = "none"
+)
+
+// Clipboard audit modes for targets.
+const (
+	clipboardAuditContent = "content"
+	clipboardAuditHash    = "hash"
+)
+
+// Target types.
+const (
+	targetTypeTCP  = "tcp"
+	targetTypeExec = "exec"
+)
+
+// Shared flag modes for targets.
+const (
+	sharedForceTrue   = "force-true"
+	sharedForceFalse  = "force-false"
+	sharedPassthrough = "passthrough"
+)
+
+// target is a named connection target.
+type target struct {
+	Name        string            `yaml:"name"`
+	Type        string            `yaml:"type"`
+	Address     string            `yaml:"address"`
+	Description string            `yaml:"description"`
+	Params      map[string]string `yaml:"params"`
+	ViewOnly    bool              `yaml:"view_only"`
+
+	ForceViewOnly bool `yaml:"force_view_only"`
+
+	Clipboard        string `yaml:"clipboard"`
+	ClipboardMaxSize int    `yaml:"clipboard_max_size"`
+	ClipboardAudit   string `yaml:"clipboard_audit"`
+
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+
+	Shared string `yaml:"shared"`
+
+	WOLMAC       string        `yaml:"wol_mac"`
+	WOLBroadcast string        `yaml:"wol_broadcast"`
+	WOLTimeout   time.Duration `yaml:"wol_timeout"`
+
+	ExecCommand string        `yaml:"exec_command"`
+	ExecTimeout time.Duration `yaml:"exec_timeout"`
+	ExecGrace   time.Duration `yaml:"exec_grace"`
+
+	Broadcast            bool     `yaml:"broadcast"`
+	BroadcastControllers []string `yaml:"broadcast_controllers"`
+}
+
+// loadTargets reads and parses a YAML (or JSON) file containing a list of
+// targets.
+func loadTargets(fn string) ([]*target, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ts, err := parseTargets(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return ts, nil
+}
+
+// parseTargets parses a YAML (or JSON) list of targets.
+func parseTargets(r io.Reader) ([]*target, error) {
+	var ts []*target
+
+	d := yaml.NewDecoder(r)
+	d.KnownFields(true)
+	if err := d.Decode(&ts); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i, t := range ts {
+		if t == nil {
+			return nil, fmt.Errorf("target %d: empty", i+1)
+		}
+		if err := t.validate(); err != nil {
+			if t.Name != "" {
+				return nil, fmt.Errorf("target %#v: %w", t.Name, err)
+			}
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("target %#v: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return ts, nil
+}
+
+// validate checks the target for errors.
+func (t *target) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if !targetNameRegexp.MatchString(t.Name) {
+		return errors.New("name must only contain letters, numbers, underscores, dashes, and periods")
+	}
+	switch t.Type {
+	case "", targetTypeTCP:
+		if t.Address == "" {
+			return errors.New("address is required")
+		}
+		if path, ok := unixSocketPath(t.Address); ok {
+			if err := checkUnixSocketPath(path); err != nil {
+				return fmt.Errorf("address: %w", err)
+			}
+			if t.WOLMAC != "" {
+				return errors.New("wol_mac can't be used with a unix socket address")
+			}
+		} else if host, port, err := net.SplitHostPort(t.Address); err != nil {
+			return fmt.Errorf("address must be in host:port or unix:/path format: %v", err)
+		} else if host == "" || port == "" {
+			return errors.New("address must be in host:port or unix:/path format")
+		}
+		if t.ExecCommand != "" || t.ExecTimeout != 0 || t.ExecGrace != 0 {
+			return errors.New("exec_command, exec_timeout, and exec_grace require type exec")
+		}
+	case targetTypeExec:
+		if !execSupported {
+			return errors.New("type exec is only supported on Unix-like systems")
+		}
+		if t.Address != "" {
+			return errors.New("address can't be used with type exec")
+		}
+		if t.WOLMAC != "" {
+			return errors.New("wol_mac can't be used with type exec")
+		}
+		if t.ExecCommand == "" {
+			return errors.New("exec_command is required for type exec")
+		}
+		if _, err := renderExecCommand(t.ExecCommand, 0, 0); err != nil {
+			return fmt.Errorf("exec_command: %w", err)
+		}
+		if t.ExecTimeout < 0 || t.ExecGrace < 0 {
+			return errors.New("exec_timeout and exec_grace must not be negative")
+		}
+	default:
+		return fmt.Errorf("type must be %s or %s", targetTypeTCP, targetTypeExec)
+	}
+	for k := range t.Params {
+		if err := checkNoVNCParam(k); err != nil {
+			return fmt.Errorf("params: %w", err)
+		}
+	}
+	if t.Password != "" && t.PasswordFile != "" {
+		return errors.New("only one of password and password_file can be specified")
+	}
+	if len(t.Password) > 8 {
+		return errors.New("password must be at most 8 characters")
+	}
+	switch t.Clipboard {
+	case "", clipboardBoth, clipboardInbound, clipboardOutbound, clipboardNone:
+	default:
+		return fmt.Errorf("clipboard must be %s, %s, %s, or %s", clipboardBoth, clipboardInbound, clipboardOutbound, clipboardNone)
+	}
+	if t.ClipboardMaxSize < 0 {
+		return errors.New("clipboard_max_size must not be negative")
+	}
+	switch t.ClipboardAudit {
+	case "", clipboardAuditContent, clipboardAuditHash:
+	default:
+		return fmt.Errorf("clipboard_audit must be %s or %s", clipboardAuditContent, clipboardAuditHash)
+	}
+	switch t.Shared {
+	case "", sharedForceTrue, sharedForceFalse, sharedPassthrough:
+	default:
+		return fmt.Errorf("shared must be %s, %s, or %s", sharedForceTrue, sharedForceFalse, sharedPassthrough)
+	}
+	if t.WOLMAC != "" {
+		if mac, err := net.ParseMAC(t.WOLMAC); err != nil {
+			return fmt.Errorf("wol_mac: %w", err)
+		} else if len(mac) != 6 {
+			return errors.New("wol_mac must be a 48-bit MAC address")
+		}
+	} else if t.WOLBroadcast != "" || t.WOLTimeout != 0 {
+		return errors.New("wol_broadcast and wol_timeout require wol_mac")
+	}
+	if t.WOLBroadcast != "" {
+		if _, _, err := net.SplitHostPort(t.WOLBroadcast); err != nil {
+			return fmt.Errorf("wol_broadcast must be in host:port format: %v", err)
+		}
+	}
+	if t.WOLTimeout < 0 {
+		return errors.New("wol_timeout must not be negative")
+	}
+	if len(t.BroadcastControllers) != 0 && !t.Broadcast {
+		return errors.New("broadcast_controllers requires broadcast")
+	}
+	return nil
+}
+
+// canControl returns true if the user is allowed to control a broadcast
+// target. If no controllers are specified, anyone can.
+func (t *target) canControl(user string) bool {
+	if len(t.BroadcastControllers) == 0 {
+		return true
+	}
+	for _, u := range t.BroadcastControllers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// vncPassword returns the VNC password to authenticate with, or nil if the
+// browser should authenticate itself. The password file is read each time so
+// it can be rotated without reloading.
+func (t *target) vncPassword() ([]byte, error) {
+	if t.PasswordFile == "" {
+		if t.Password == "" {
+			return nil, nil
+		}
+		return []byte(t.Password), nil
+	}
+	buf, err := ioutil.ReadFile(t.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("read password file: %w", err)
+	}
+	buf = bytes.TrimRight(buf, "\r\n")
+	if len(buf) > 8 {
+		return nil, fmt.Errorf("password in %s must be at most 8 characters", t.PasswordFile)
+	}
+	return buf, nil
+}
+
+// addr returns the address of the target for logging and the CIDR
+// whitelist/blacklist, which is a pseudo-address for exec targets.
+func (t *target) addr() string {
+	if t.Type == targetTypeExec {
+		return "exec:" + t.Name
+	}
+	return t.Address
+}
+
+// dialer returns the dialFunc for connecting to the target, which starts or
+// wakes it up first if needed.
+func (t *target) dialer() dialFunc {
+	if t.Type == targetTypeExec {
+		timeout, grace := t.ExecTimeout, t.ExecGrace
+		if timeout == 0 {
+			timeout = defaultExecTimeout
+		}
+		if grace == 0 {
+			grace = defaultExecGrace
+		}
+		return execDialer(t.Name, t.ExecCommand, timeout, grace)
+	}
+	if t.WOLMAC == "" {
+		return addrDialer(t.Address)
+	}
+	mac, _ := net.ParseMAC(t.WOLMAC) // checked by validate
+	broadcast, timeout := t.WOLBroadcast, t.WOLTimeout
+	if broadcast == "" {
+		broadcast = defaultWOLBroadcast
+	}
+	if timeout == 0 {
+		timeout = defaultWOLTimeout
+	}
+	return wolDialer(t.Address, mac, broadcast, timeout)
+}
+
+// targetsByName returns a map of targets by name.
+func targetsByName(ts []*target) map[string]*target {
+	m := make(map[string]*target, len(ts))
+	for _, t := range ts {
+		m[t.Name] = t
+	}
+	return m
+}
+
+// targetInfo is the information about a target exposed to the main screen.
+type targetInfo struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Params      map[string]string `json:"params"`
+	ViewOnly    bool              `json:"view_only"`
+}
+
+// targetsInfo returns the information about targets to expose to the main
+// screen (note that this intentionally doesn't include the address).
+func targetsInfo(ts []*target) []targetInfo {
+	res := make([]targetInfo, len(ts))
+	for i, t := range ts {
+		res[i] = targetInfo{
+			Name:        t.Name,
+			Description: t.Description,
+			Params:      t.Params,
+			ViewOnly:    t.ViewOnly || t.ForceViewOnly,
+		}
+		if res[i].Params == nil {
+			res[i].Params = map[string]string{}
+		}
+	}
+	return res
+}
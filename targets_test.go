@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseTargets(t *testing.T) {
+	ts, err := parseTargets(strings.NewReader(`
+- name: desktop
+  address: 10.0.0.5:5900
+  description: Office desktop
+  params:
+    resize: remote
+  view_only: true
+- name: server-1
+  address: "[a:b:c:d::1]:5901"
+- name: vm1
+  address: unix:/run/vnc/vm1.sock
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ts) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(ts))
+	}
+	if ts[0].Name != "desktop" || ts[0].Address != "10.0.0.5:5900" || ts[0].Description != "Office desktop" || ts[0].Params["resize"] != "remote" || !ts[0].ViewOnly {
+		t.Errorf("incorrectly parsed target %+v", ts[0])
+	}
+	if ts[1].Name != "server-1" || ts[1].Address != "[a:b:c:d::1]:5901" || ts[1].ViewOnly {
+		t.Errorf("incorrectly parsed target %+v", ts[1])
+	}
+	if ts[2].Name != "vm1" || ts[2].addr() != "unix:/run/vnc/vm1.sock" {
+		t.Errorf("incorrectly parsed target %+v", ts[2])
+	}
+
+	ts, err = parseTargets(strings.NewReader(`[{"name": "json", "address": "localhost:5900"}]`))
+	if err != nil {
+		t.Errorf("unexpected error parsing json: %v", err)
+	} else if len(ts) != 1 || ts[0].Name != "json" {
+		t.Errorf("incorrectly parsed json targets")
+	}
+
+	ts, err = parseTargets(strings.NewReader(``))
+	if err != nil {
+		t.Errorf("unexpected error parsing empty file: %v", err)
+	} else if len(ts) != 0 {
+		t.Errorf("expected no targets")
+	}
+
+	for _, c := range []string{
+		`- address: localhost:5900`,
+		`- name: test`,
+		`- {name: "a b", address: "localhost:5900"}`,
+		`- {name: test, address: localhost}`,
+		`- {name: test, address: ":5900"}`,
+		`- {name: test, address: localhost:5900, unknown: true}`,
+		`- {name: test, address: localhost:5900, params: {password: test}}`,
+		`- {name: test, address: localhost:5900, params: {unknown: test}}`,
+		"- {name: test, address: localhost:5900}\n- {name: test, address: localhost:5901}",
+		`- {name: test, address: localhost:5900, password: test, password_file: /dev/null}`,
+		`- {name: test, address: localhost:5900, password: toolongpw}`,
+		`- {name: test, address: localhost:5900, clipboard: sideways}`,
+		`- {name: test, address: localhost:5900, clipboard_max_size: -1}`,
+		`- {name: test, address: localhost:5900, clipboard_audit: yes}`,
+		`- {name: test, address: localhost:5900, broadcast_controllers: [alice]}`,
+		`- {name: test, address: localhost:5900, shared: true}`,
+		`- {name: test, address: localhost:5900, wol_mac: "01:23:45"}`,
+		`- {name: test, address: localhost:5900, wol_broadcast: "10.0.0.255:9"}`,
+		`- {name: test, address: localhost:5900, wol_mac: "01:23:45:67:89:ab", wol_broadcast: "10.0.0.255"}`,
+		`- {name: test, address: localhost:5900, wol_mac: "01:23:45:67:89:ab", wol_timeout: -1s}`,
+		`- {name: test, type: ftp, address: localhost:5900}`,
+		`- {name: test, address: "unix:run/vnc.sock"}`,
+		`- {name: test, address: "unix:/run/vnc.sock", wol_mac: "01:23:45:67:89:ab"}`,
+		`- {name: test, address: localhost:5900, exec_command: x11vnc}`,
+		`- {name: test, type: exec}`,
+		`- {name: test, type: exec, address: localhost:5900, exec_command: x11vnc}`,
+		`- {name: test, type: exec, exec_command: "x11vnc -rfbport {{port"}`,
+		`- {name: test, type: exec, exec_command: x11vnc, exec_grace: -1s}`,
+		`name: test`,
+	} {
+		if _, err := parseTargets(strings.NewReader(c)); err == nil {
+			t.Errorf("expected error parsing %#v", c)
+		}
+	}
+}
+
+func TestTargetPassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+
+	for _, c := range []struct {
+		Target   target
+		Password []byte
+		Error    bool
+	}{
+		{target{}, nil, false},
+		{target{Password: "secret"}, []byte("secret"), false},
+		{target{PasswordFile: f.Name()}, []byte("secret"), false},
+		{target{PasswordFile: f.Name() + ".nonexistent"}, nil, true},
+	} {
+		pw, err := c.Target.vncPassword()
+		if c.Error {
+			if err == nil {
+				t.Errorf("%+v: expected error", c.Target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", c.Target, err)
+		} else if !bytes.Equal(pw, c.Password) || (pw == nil) != (c.Password == nil) {
+			t.Errorf("%+v: expected password %q, got %q", c.Target, c.Password, pw)
+		}
+	}
+}
+
+func TestTargetHandler(t *testing.T) {
+	targets := targetsByName([]*target{
+		{Name: "allowed", Address: "10.0.0.1:5900"},
+		{Name: "blocked", Address: "127.0.0.1:5900"},
+		{Name: "unix-allowed", Address: "unix:/run/vnc/vm1.sock"},
+		{Name: "unix-blocked", Address: "unix:/tmp/vm1.sock"},
+	})
+	testCase := func(url string, expectedStatus int, expectedAddr string) func(*testing.T) {
+		return func(t *testing.T) {
+			r := httptest.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+
+			var ws bool
+			func() {
+				defer func() {
+					// workaround for websocket library issue with a fake http response
+					if err := recover(); strings.Contains(fmt.Sprint(err), "not http.Hijacker") {
+						ws = true
+					} else if err != nil {
+						panic(err)
+					}
+				}()
+				m := mux.NewRouter()
+				m.Handle("/vnc/t/{name:[a-zA-Z0-9_.-]+}", targetHandler(targets, proxyPolicy{}, mustParseCIDRList("10.0.0.0/24"), true, []string{"/run/vnc/*.sock"}))
+				m.ServeHTTP(w, r)
+			}()
+
+			c := w.Result().StatusCode
+			if ws && c == 200 {
+				c = 101
+			}
+			if c != expectedStatus {
+				t.Errorf("expected status %d, got %d", expectedStatus, c)
+			}
+
+			if a := w.Result().Header.Get("X-Target-Addr"); a != expectedAddr {
+				t.Errorf("expected addr %#v, got %#v", expectedAddr, a)
+			}
+		}
+	}
+	t.Run("Allowed", testCase("http://example.com/vnc/t/allowed", 101, "10.0.0.1:5900"))
+	t.Run("Blocked", testCase("http://example.com/vnc/t/blocked", 401, ""))
+	t.Run("UnixAllowed", testCase("http://example.com/vnc/t/unix-allowed", 101, "unix:/run/vnc/vm1.sock"))
+	t.Run("UnixBlocked", testCase("http://example.com/vnc/t/unix-blocked", 401, ""))
+	t.Run("Unknown", testCase("http://example.com/vnc/t/unknown", 404, ""))
+}
+
+func TestIndexTargets(t *testing.T) {
+	for _, ts := range [][]*target{
+		nil,
+		{{Name: "desktop", Address: "10.0.0.5:5900", Description: "Office <desktop>", Params: map[string]string{"resize": "remote"}, ViewOnly: true}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := indexTMPL.Execute(buf, map[string]interface{}{
+			"host":    "localhost",
+			"port":    5900,
+			"params":  map[string]string{"resize": "scale"},
+			"targets": targetsInfo(ts),
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(ts) == 0 {
+			if strings.Contains(buf.String(), `<select id="target"`) {
+				t.Errorf("expected target picker not to be shown without targets")
+			}
+			continue
+		}
+		for _, exp := range []string{
+			`<select id="target"`,
+			`<option value="desktop">Office &lt;desktop&gt; (desktop)</option>`,
+			`"name":"desktop"`,
+			`"view_only":true`,
+		} {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("expected index to contain %#v", exp)
+			}
+		}
+		if strings.Contains(buf.String(), "10.0.0.5") {
+			t.Errorf("expected target address not to be exposed")
+		}
+	}
+}
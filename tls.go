@@ -0,0 +1,217 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader loads a TLS certificate and key from disk, and reloads them when
+// either file is modified. If a reload fails, the previous certificate is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// newCertReloader loads the certificate and key, and returns a certReloader
+// which checks for changes at most once per second.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, interval: time.Second}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= c.interval {
+		if err := c.reloadLocked(); err != nil {
+			logf(levelWarn, "error reloading tls certificate, keeping the old one: %v.\n", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate if it has changed.
+func (c *certReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reloadLocked()
+}
+
+func (c *certReloader) reloadLocked() error {
+	c.checked = time.Now()
+
+	cfi, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	kfi, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && cfi.ModTime().Equal(c.certMod) && kfi.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load x509 key pair: %w", err)
+	}
+	if c.cert != nil {
+		logf(levelInfo, "Reloaded tls certificate from %s.\n", c.certFile)
+	}
+	c.cert, c.certMod, c.keyMod = &cert, cfi.ModTime(), kfi.ModTime()
+	return nil
+}
+
+// ensureSelfSignedCert generates a self-signed certificate for hosts and writes
+// it to certFile and keyFile if neither of them exist yet.
+func ensureSelfSignedCert(certFile, keyFile string, hosts []string) (bool, error) {
+	certExists, err := fileExists(certFile)
+	if err != nil {
+		return false, err
+	}
+	keyExists, err := fileExists(keyFile)
+	if err != nil {
+		return false, err
+	}
+	if certExists && keyExists {
+		return false, nil
+	} else if certExists || keyExists {
+		return false, errors.New("only one of the certificate and key exists")
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert(hosts, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if err := writeFileExcl(keyFile, keyPEM, 0600); err != nil {
+		return false, err
+	}
+	if err := writeFileExcl(certFile, certPEM, 0644); err != nil {
+		os.Remove(keyFile)
+		return false, err
+	}
+	return true, nil
+}
+
+// generateSelfSignedCert generates a PEM-encoded self-signed ECDSA certificate
+// and key valid for hosts (which may be hostnames or IPs).
+func generateSelfSignedCert(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"easy-novnc"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(tmpl.DNSNames) != 0 {
+		tmpl.Subject.CommonName = tmpl.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// selfSignedHosts returns the hostnames to include in a generated certificate
+// for the listen addresses.
+func selfSignedHosts(addrs []string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		hosts = append(hosts, h)
+	}
+	for _, addr := range addrs {
+		if _, ok := unixSocketPath(addr); ok || addr == systemdListenAddr || strings.HasPrefix(addr, systemdListenAddr+":") {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(addr); err == nil && h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// fileExists checks whether a file exists.
+func fileExists(name string) (bool, error) {
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeFileExcl writes a file, failing if it already exists.
+func writeFileExcl(name string, buf []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
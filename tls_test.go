@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	certFile, keyFile := filepath.Join(d, "cert.pem"), filepath.Join(d, "key.pem")
+
+	if created, err := ensureSelfSignedCert(certFile, keyFile, []string{"example.com", "127.0.0.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !created {
+		t.Errorf("expected certificate to be created")
+	}
+
+	buf, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, _ := pem.Decode(buf)
+	if b == nil {
+		t.Fatalf("certificate is not pem-encoded")
+	}
+
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cert.VerifyHostname("example.com"); err != nil {
+		t.Errorf("expected cert to be valid for example.com: %v", err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("expected cert to be valid for 127.0.0.1: %v", err)
+	}
+
+	if created, err := ensureSelfSignedCert(certFile, keyFile, []string{"example.com"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if created {
+		t.Errorf("expected existing certificate to be kept")
+	}
+
+	if nbuf, _ := ioutil.ReadFile(certFile); !bytes.Equal(buf, nbuf) {
+		t.Errorf("expected existing certificate not to be overwritten")
+	}
+
+	os.Remove(keyFile)
+	if _, err := ensureSelfSignedCert(certFile, keyFile, []string{"example.com"}); err == nil {
+		t.Errorf("expected error when only the certificate exists")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	certFile, keyFile := filepath.Join(d, "cert.pem"), filepath.Join(d, "key.pem")
+	writeCert := func(host string, mod time.Time) {
+		certPEM, keyPEM, err := generateSelfSignedCert([]string{host}, time.Now())
+		if err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			panic(err)
+		}
+		os.Chtimes(certFile, mod, mod)
+		os.Chtimes(keyFile, mod, mod)
+	}
+	leaf := func(c *certReloader) *x509.Certificate {
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		x, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			panic(err)
+		}
+		return x
+	}
+
+	writeCert("one.example.com", time.Now().Add(-time.Hour))
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.interval = 0
+
+	if cn := leaf(c).Subject.CommonName; cn != "one.example.com" {
+		t.Errorf("expected initial certificate, got %#v", cn)
+	}
+
+	writeCert("two.example.com", time.Now())
+	if cn := leaf(c).Subject.CommonName; cn != "two.example.com" {
+		t.Errorf("expected reloaded certificate, got %#v", cn)
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		panic(err)
+	}
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if cn := leaf(c).Subject.CommonName; cn != "two.example.com" {
+		t.Errorf("expected old certificate to be kept after failed reload, got %#v", cn)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("expected error loading invalid key")
+	}
+}
@@ -0,0 +1,66 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// unixSocketPrefix is the prefix for unix socket addresses (e.g.
+// unix:/run/vnc/vm1.sock).
+const unixSocketPrefix = "unix:"
+
+// unixSocketPath returns the path of a unix socket address, or false if addr
+// isn't one.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixSocketPrefix), true
+}
+
+// checkUnixSocketPath checks that a unix socket path is absolute and clean.
+func checkUnixSocketPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("unix socket path %#v must be absolute", path)
+	}
+	if filepath.Clean(path) != path {
+		return fmt.Errorf("unix socket path %#v must be clean (expected %#v)", path, filepath.Clean(path))
+	}
+	return nil
+}
+
+// checkUnixSocketWhitelist checks a unix socket path against a whitelist of
+// glob patterns (see filepath.Match).
+func checkUnixSocketWhitelist(path string, whitelist []string) error {
+	if err := checkUnixSocketPath(path); err != nil {
+		return err
+	}
+	for _, pattern := range whitelist {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unix socket %s does not match any whitelisted path", path)
+}
+
+// unixDialer returns a dialFunc which connects to a unix socket.
+func unixDialer(path string) dialFunc {
+	return func(r *http.Request) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+}
+
+// addrDialer returns a dialFunc which connects to a tcp or unix socket
+// address.
+func addrDialer(addr string) dialFunc {
+	if path, ok := unixSocketPath(addr); ok {
+		return unixDialer(path)
+	}
+	return tcpDialer(addr)
+}
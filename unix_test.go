@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckUnixSocketWhitelist(t *testing.T) {
+	whitelist := []string{"/run/vnc/*.sock", "/tmp/vm1"}
+	for path, allowed := range map[string]bool{
+		"/run/vnc/vm1.sock":        true,
+		"/tmp/vm1":                 true,
+		"/run/vnc/vm1":             false,
+		"/run/vnc/sub/vm1.sock":    false,
+		"/run/vnc/../vnc/vm1.sock": false,
+		"/run/vnc//vm1.sock":       false,
+		"run/vnc/vm1.sock":         false,
+		"/tmp/vm2":                 false,
+	} {
+		if err := checkUnixSocketWhitelist(path, whitelist); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%t, got error %v", path, allowed, err)
+		}
+	}
+	if err := checkUnixSocketWhitelist("/run/vnc/vm1.sock", nil); err == nil {
+		t.Errorf("expected unix sockets to be denied with an empty whitelist")
+	}
+}
+
+func TestAddrDialer(t *testing.T) {
+	d, err := ioutil.TempDir("", "easy-novnc")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+
+	path := filepath.Join(d, "vnc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("RFB"))
+			c.Close()
+		}
+	}()
+
+	conn, err := addrDialer("unix:" + path)(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().Network() != "unix" {
+		t.Errorf("expected unix connection, got %s", conn.RemoteAddr().Network())
+	}
+	expectRead(t, "magic", conn, []byte("RFB"))
+}
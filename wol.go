@@ -0,0 +1,83 @@
+// +build !index_generate
+// +build !novnc_generate
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultWOLBroadcast is the address magic packets are sent to if the target
+// doesn't specify one.
+const defaultWOLBroadcast = "255.255.255.255:9"
+
+// defaultWOLTimeout is how long to wait for a target to wake up if it doesn't
+// specify a timeout.
+const defaultWOLTimeout = time.Minute * 2
+
+// wolRetryInterval is how often the magic packet is re-sent and the dial is
+// retried while waiting for a target to wake up.
+var wolRetryInterval = time.Second * 5
+
+// wolMagicPacket returns the magic packet for a MAC address (6 bytes of 0xFF
+// followed by the address repeated 16 times).
+func wolMagicPacket(mac net.HardwareAddr) []byte {
+	return append(bytes.Repeat([]byte{0xFF}, 6), bytes.Repeat(mac, 16)...)
+}
+
+// sendMagicPacket sends a Wake-on-LAN magic packet for mac to the UDP
+// broadcast address addr.
+func sendMagicPacket(mac net.HardwareAddr, addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(wolMagicPacket(mac))
+	return err
+}
+
+// wolDialer returns a dialFunc which connects to addr, and if that fails,
+// wakes the target with a magic packet for mac sent to broadcast, then retries
+// until timeout or until the request is cancelled. If it still fails, the error
+// is a *rfbFailure with a reason which can be shown to the user.
+func wolDialer(addr string, mac net.HardwareAddr, broadcast string, timeout time.Duration) dialFunc {
+	return func(r *http.Request) (net.Conn, error) {
+		conn, err := (&net.Dialer{Timeout: wolRetryInterval}).DialContext(r.Context(), "tcp", addr)
+		if err == nil || r.Context().Err() != nil {
+			return conn, err
+		}
+		logr(r, levelInfo, "error connecting to %s for %s, sending wake-on-lan packet to %s: %v\n", addr, requestWho(r), mac, err)
+
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(r.Context(), start.Add(timeout))
+		defer cancel()
+
+		for {
+			if err := sendMagicPacket(mac, broadcast); err != nil {
+				logr(r, levelWarn, "error sending wake-on-lan packet to %s via %s: %v\n", mac, broadcast, err)
+			}
+			next := time.Now().Add(wolRetryInterval)
+			if conn, err = (&net.Dialer{Deadline: next}).DialContext(ctx, "tcp", addr); err == nil {
+				logr(r, levelInfo, "woke up %s for %s after %s\n", addr, requestWho(r), time.Since(start).Round(time.Second))
+				return conn, nil
+			}
+			t := time.NewTimer(time.Until(next))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				if err := r.Context().Err(); err != nil {
+					logr(r, levelDebug, "stopped waiting for %s to wake up for %s: %v\n", addr, requestWho(r), err)
+					return nil, err
+				}
+				return nil, &rfbFailure{fmt.Sprintf("wake up %s: %v", addr, err), fmt.Sprintf("The target is asleep and didn't wake up within %s.", timeout)}
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendMagicPacket(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	mac, _ := net.ParseMAC("01:23:45:67:89:ab")
+	if err := sendMagicPacket(mac, l.LocalAddr().String()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 200)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for i := 0; i < 16; i++ {
+		exp = append(exp, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab)
+	}
+	if !bytes.Equal(buf[:n], exp) {
+		t.Errorf("expected magic packet %x, got %x", exp, buf[:n])
+	}
+}
+
+func TestWOLDialer(t *testing.T) {
+	defer func(d time.Duration) {
+		wolRetryInterval = d
+	}(wolRetryInterval)
+	wolRetryInterval = time.Millisecond * 50
+
+	mac, _ := net.ParseMAC("01:23:45:67:89:ab")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// an address which isn't listening yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	wake, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer wake.Close()
+
+	woke := make(chan net.Listener, 1)
+	go func() {
+		// start listening after the first magic packet
+		buf := make([]byte, 200)
+		if _, _, err := wake.ReadFrom(buf); err != nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			panic(err)
+		}
+		woke <- l
+	}()
+
+	conn, err := wolDialer(addr, mac, wake.LocalAddr().String(), time.Second*5)(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	(<-woke).Close()
+
+	n := time.Now()
+	_, err = wolDialer(addr, mac, wake.LocalAddr().String(), time.Millisecond*200)(r)
+	if f, ok := err.(*rfbFailure); !ok || !strings.Contains(f.Reason, "didn't wake up") {
+		t.Errorf("expected wake up failure, got %v", err)
+	}
+	if d := time.Since(n); d > time.Second {
+		t.Errorf("expected dial to give up after the timeout, took %s", d)
+	}
+
+	// it stops waiting if the user goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	n = time.Now()
+	if _, err := wolDialer(addr, mac, wake.LocalAddr().String(), time.Second*5)(r.WithContext(ctx)); err == nil {
+		t.Errorf("expected error")
+	} else if _, ok := err.(*rfbFailure); ok {
+		t.Errorf("expected cancellation error, got %v", err)
+	}
+	if d := time.Since(n); d > time.Second {
+		t.Errorf("expected dial to stop when the request was cancelled, took %s", d)
+	}
+}